@@ -0,0 +1,582 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+const (
+	ARCHIVE_NONE = iota
+	ARCHIVE_ZIP
+	ARCHIVE_TAR
+	ARCHIVE_TAR_GZ
+	ARCHIVE_TAR_XZ
+)
+
+var archiveSuffixes = []struct {
+	suffix string
+	format int
+}{
+	{".tar.gz", ARCHIVE_TAR_GZ},
+	{".tgz", ARCHIVE_TAR_GZ},
+	{".tar.xz", ARCHIVE_TAR_XZ},
+	{".txz", ARCHIVE_TAR_XZ},
+	{".tar", ARCHIVE_TAR},
+	{".zip", ARCHIVE_ZIP},
+}
+
+// Returns the format of the archive, and its name without the extension
+func archiveFormat(name string) (int, string) {
+	lower := strings.ToLower(name)
+	for _, archive := range archiveSuffixes {
+		if strings.HasSuffix(lower, archive.suffix) && len(name) > len(archive.suffix) {
+			return archive.format, name[:len(name)-len(archive.suffix)]
+		}
+	}
+
+	return ARCHIVE_NONE, name
+}
+
+// Joins the name of a member of an archive to the destination, making sure it
+// does not escape it with something like "../../.bashrc"
+func safeJoin(dest, name string) (string, error) {
+	path := filepath.Join(dest, name)
+	if path != dest && !strings.HasPrefix(path, dest+string(filepath.Separator)) {
+		return "", errors.New("illegal path in archive '" + name + "'")
+	}
+
+	return path, nil
+}
+
+// Joins the name of a member to the destination like safeJoin, also making sure
+// that nothing gets written through symbolic links extracted before it, since
+// checking their targets by name alone can be fooled by links to other links
+func extractTarget(dest, name string) (string, error) {
+	target, err := safeJoin(dest, name)
+	if err != nil {
+		return "", err
+	}
+
+	for path := target; path != dest; path = filepath.Dir(path) {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", errors.New("illegal path through symbolic link in archive '" + name + "'")
+		}
+	}
+
+	return target, nil
+}
+
+// Symbolic links pointing outside of the destination would allow later
+// members to be written through them
+func checkLinkTarget(dest, path, target string) error {
+	if path == dest {
+		return errors.New("illegal link in archive replacing the destination")
+	}
+
+	dir, err := filepath.Rel(dest, filepath.Dir(path))
+	if err != nil || filepath.IsAbs(target) {
+		return errors.New("illegal link target in archive '" + target + "'")
+	}
+
+	if _, err := safeJoin(dest, filepath.Join(dir, target)); err != nil {
+		return errors.New("illegal link target in archive '" + target + "'")
+	}
+	return nil
+}
+
+func uniquePath(path string) string {
+	unique := path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(unique); errors.Is(err, fs.ErrNotExist) {
+			return unique
+		}
+
+		unique = path + "-" + strconv.Itoa(i)
+	}
+}
+
+func writeFileContext(ctx context.Context, path string, src io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = copyContext(ctx, file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func openTar(file io.Reader, format int) (io.Reader, error) {
+	switch format {
+	case ARCHIVE_TAR_GZ:
+		return gzip.NewReader(file)
+	case ARCHIVE_TAR_XZ:
+		return xz.NewReader(file)
+	default:
+		return file, nil
+	}
+}
+
+// Returns the name to extract a member to, relative to the directory
+// containing the selected prefix. An empty prefix selects every member as is.
+func selectMember(name, prefix string) (string, bool) {
+	if prefix == "" {
+		return name, true
+	}
+
+	name = cleanMemberName(name)
+	if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+		return "", false
+	}
+
+	if parent := path.Dir(prefix); parent != "." {
+		name = name[len(parent)+1:]
+	}
+	return name, true
+}
+
+func extractTar(ctx context.Context, path string, format int, dest, prefix string, progress *Progress) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := openTar(file, format)
+	if err != nil {
+		return err
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name, ok := selectMember(header.Name, prefix)
+		if !ok {
+			continue
+		}
+
+		target, err := extractTarget(dest, name)
+		if err != nil {
+			return err
+		}
+		progress.Set(name)
+
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+
+		case tar.TypeReg:
+			err = writeFileContext(ctx, target, reader, mode|0600)
+
+		case tar.TypeSymlink:
+			if err = checkLinkTarget(dest, target, header.Linkname); err == nil {
+				if err = os.MkdirAll(filepath.Dir(target), 0750); err == nil {
+					err = os.Symlink(header.Linkname, target)
+				}
+			}
+
+		case tar.TypeLink:
+			name, ok := selectMember(header.Linkname, prefix)
+			if !ok {
+				return errors.New("hard link target '" + header.Linkname + "' is not being extracted")
+			}
+
+			var source string
+			if source, err = extractTarget(dest, name); err == nil {
+				err = os.Link(source, target)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Extracts the member of the archive selected by prefix, along with everything
+// within it, into dest. An empty prefix extracts the entire archive.
+func extractMembers(ctx context.Context, archive, prefix, dest string, progress *Progress) error {
+	format, _ := archiveFormat(filepath.Base(archive))
+	if format == ARCHIVE_ZIP {
+		return extractZip(ctx, archive, dest, prefix, progress)
+	}
+	return extractTar(ctx, archive, format, dest, prefix, progress)
+}
+
+func extractZip(ctx context.Context, path string, dest, prefix string, progress *Progress) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, member := range reader.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name, ok := selectMember(member.Name, prefix)
+		if !ok {
+			continue
+		}
+
+		target, err := extractTarget(dest, name)
+		if err != nil {
+			return err
+		}
+		progress.Set(name)
+
+		info := member.FileInfo()
+		if info.IsDir() {
+			if err := os.MkdirAll(target, info.Mode().Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		src, err := member.Open()
+		if err != nil {
+			return err
+		}
+
+		// Symbolic links are stored with their target as the contents
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var link []byte
+			link, err = io.ReadAll(src)
+			if err == nil {
+				if err = checkLinkTarget(dest, target, string(link)); err == nil {
+					err = os.Symlink(string(link), target)
+				}
+			}
+		} else {
+			err = writeFileContext(ctx, target, src, info.Mode().Perm()|0600)
+		}
+
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Calls visit for every file within the items, with names relative to the
+// directory containing each item. Symbolic links are not followed.
+func walkItems(ctx context.Context, filesystems *Filesystems, items []string, visit func(path, name string, info fs.FileInfo) error) error {
+	var walk func(path, name string) error
+	walk = func(path, name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := filesystems.For(path).Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if err := visit(path, name, info); err != nil || !info.IsDir() {
+			return err
+		}
+
+		children, err := filesystems.List(path)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if err := walk(child.path, name+"/"+child.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, item := range items {
+		if err := walk(item, filepath.Base(item)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFileContext(ctx context.Context, dst io.Writer, filesystems *Filesystems, path string) error {
+	file, err := filesystems.For(path).Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = copyContext(ctx, dst, file)
+	return err
+}
+
+func writeTar(ctx context.Context, w io.Writer, filesystems *Filesystems, archivePath string, items []string, progress *Progress) error {
+	writer := tar.NewWriter(w)
+
+	err := walkItems(ctx, filesystems, items, func(path, name string, info fs.FileInfo) error {
+		if path == archivePath {
+			return nil
+		}
+
+		var link string
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			var err error
+			if link, err = filesystems.For(path).Readlink(path); err != nil {
+				return err
+			}
+
+		case !info.Mode().IsRegular() && !info.IsDir():
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		progress.Set(name)
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			return copyFileContext(ctx, writer, filesystems, path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func writeZip(ctx context.Context, w io.Writer, filesystems *Filesystems, archivePath string, items []string, progress *Progress) error {
+	writer := zip.NewWriter(w)
+
+	err := walkItems(ctx, filesystems, items, func(path, name string, info fs.FileInfo) error {
+		if path == archivePath {
+			return nil
+		}
+
+		isLink := info.Mode()&fs.ModeSymlink != 0
+		if !isLink && !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else if info.Mode().IsRegular() {
+			header.Method = zip.Deflate
+		}
+
+		progress.Set(name)
+		dst, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if isLink {
+			link, err := filesystems.For(path).Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.WriteString(dst, link)
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			return copyFileContext(ctx, dst, filesystems, path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Half written archives are removed, while anything already at the path is
+// left alone
+func writeArchive(ctx context.Context, filesystems *Filesystems, path string, format int, items []string, progress *Progress) error {
+	filesystem := filesystems.For(path)
+	file, err := filesystem.Create(path, os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ARCHIVE_ZIP:
+		err = writeZip(ctx, file, filesystems, path, items, progress)
+
+	case ARCHIVE_TAR:
+		err = writeTar(ctx, file, filesystems, path, items, progress)
+
+	case ARCHIVE_TAR_GZ:
+		compressor := gzip.NewWriter(file)
+		if err = writeTar(ctx, compressor, filesystems, path, items, progress); err == nil {
+			err = compressor.Close()
+		}
+
+	case ARCHIVE_TAR_XZ:
+		var compressor *xz.Writer
+		if compressor, err = xz.NewWriter(file); err == nil {
+			if err = writeTar(ctx, compressor, filesystems, path, items, progress); err == nil {
+				err = compressor.Close()
+			}
+		}
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		filesystem.Remove(path)
+	}
+	return err
+}
+
+// Extracts the archive under the cursor into a new directory named after it
+func (fm *Fm) ExtractArchive() {
+	if len(fm.items) == 0 {
+		return
+	}
+
+	item := fm.items[fm.cursor]
+	format, base := archiveFormat(item.name)
+	if format == ARCHIVE_NONE || item.isDir {
+		fm.message = errors.New("'" + item.name + "' is not a supported archive")
+		return
+	}
+
+	if !fm.filesystems.IsLocal(item.path) {
+		fm.message = errors.New("archives can only be extracted on the local disk")
+		return
+	}
+
+	dest := uniquePath(filepath.Join(fm.path, base))
+	fm.message = fm.RunCancellable("Extracting", func(ctx context.Context, progress *Progress) error {
+		if err := os.Mkdir(dest, 0750); err != nil {
+			return err
+		}
+
+		err := extractMembers(ctx, item.path, "", dest, progress)
+
+		// Don't leave half extracted archives lying around
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+		return err
+	})
+
+	fm.Refresh()
+	fm.FindExact(filepath.Base(dest))
+}
+
+// Compresses the marked items, otherwise the item under the cursor, into an
+// archive in the current directory. The format is chosen by the extension.
+func (fm *Fm) CreateArchive() {
+	items := []string{}
+	if len(fm.marked) > 0 {
+		items = sortedMarked(fm.marked)
+	} else if len(fm.items) > 0 {
+		items = append(items, fm.items[fm.cursor].path)
+	} else {
+		return
+	}
+
+	init := "archive.tar.gz"
+	if len(items) == 1 {
+		init = filepath.Base(items[0]) + ".tar.gz"
+	}
+
+	name, ok := fm.Prompt("Archive: ", init, nil, fm.CompletePath, HISTORY_CREATE)
+	if !ok || name == "" {
+		return
+	}
+
+	format, _ := archiveFormat(name)
+	if format == ARCHIVE_NONE {
+		fm.message = errors.New("unsupported archive format '" + name + "'")
+		return
+	}
+
+	path := filepath.Join(fm.path, name)
+	fm.message = fm.RunCancellable("Compressing", func(ctx context.Context, progress *Progress) error {
+		return writeArchive(ctx, fm.filesystems, path, format, items, progress)
+	})
+
+	if fm.message == nil && len(fm.marked) > 0 {
+		fm.marked = make(map[string]bool)
+	}
+
+	fm.Refresh()
+	fm.FindExact(name)
+}
+
+func (fm *Fm) ArchiveCommand(ch gc.Key) {
+	if (ch == 'x' || ch == 'c') && !fm.CheckWritable(fm.path) {
+		return
+	}
+
+	switch ch {
+	case 'x':
+		fm.ExtractArchive()
+
+	case 'c':
+		fm.CreateArchive()
+
+	case 27:
+		return
+
+	default:
+		fm.message = errors.New("unknown archive command '" + gc.KeyString(ch) + "'")
+	}
+}
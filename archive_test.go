@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type archiveEntry struct {
+	name string
+	link string // Creates a symbolic link when set
+	body string
+}
+
+// Symbolic links are created relative to the directory, and then another link
+// is created through the first one, leading outside of the destination
+var traversalEntries = []archiveEntry{
+	{name: "d", link: "."},
+	{name: "d/e", link: "../outside"},
+	{name: "e/pwned", body: "pwned"},
+}
+
+// Links named after the destination itself would replace it
+var destinationLinkEntries = map[string][]archiveEntry{
+	"dot":       {{name: ".", link: "../outside"}, {name: "pwned", body: "pwned"}},
+	"dot-slash": {{name: "./", link: "../outside"}, {name: "pwned", body: "pwned"}},
+}
+
+func writeTestTar(t *testing.T, path string, entries []archiveEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := tar.NewWriter(file)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.body))}
+		if entry.link != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		}
+
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := writer.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestZip(t *testing.T, path string, entries []archiveEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name}
+		body := entry.body
+		if entry.link != "" {
+			header.SetMode(fs.ModeSymlink | 0777)
+			body = entry.link
+		} else {
+			header.SetMode(0644)
+		}
+
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	tests := map[string][]archiveEntry{"traversal": traversalEntries}
+	for name, entries := range destinationLinkEntries {
+		tests[name] = entries
+	}
+
+	for name, entries := range tests {
+		for _, ext := range []string{".tar", ".zip"} {
+			// Zip writers refuse contents for names ending with a slash
+			if ext == ".zip" && strings.HasSuffix(entries[0].name, "/") {
+				continue
+			}
+
+			t.Run(name+ext, func(t *testing.T) {
+				root := t.TempDir()
+				archive := filepath.Join(root, name+ext)
+				if ext == ".zip" {
+					writeTestZip(t, archive, entries)
+				} else {
+					writeTestTar(t, archive, entries)
+				}
+
+				dest := filepath.Join(root, "dest")
+				if err := os.Mkdir(dest, 0750); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := extractMembers(context.Background(), archive, "", dest, &Progress{}); err == nil {
+					t.Error("extracting through a symbolic link succeeded")
+				}
+
+				if _, err := os.Lstat(filepath.Join(root, "outside", "pwned")); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("file written outside of the destination: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestExtractMembers(t *testing.T) {
+	root := t.TempDir()
+	archive := filepath.Join(root, "good.tar")
+	writeTestTar(t, archive, []archiveEntry{
+		{name: "dir/file", body: "contents"},
+		{name: "dir/link", link: "file"},
+	})
+
+	dest := filepath.Join(root, "dest")
+	if err := os.Mkdir(dest, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractMembers(context.Background(), archive, "", dest, &Progress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dest, "dir", "link"))
+	if err != nil || string(contents) != "contents" {
+		t.Errorf("got %q, %v", contents, err)
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{
+		"/src/dir/file":   "contents",
+		"/src/dir/empty/": "",
+	})
+	if err := mem.Symlink("file", "/src/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeArchive(context.Background(), filesystems, "/src/dir.tar", ARCHIVE_TAR, []string{"/src/dir"}, &Progress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := tar.NewReader(strings.NewReader(mem.contents(t, "/src/dir.tar")))
+	got := map[string]string{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[header.Name] = string(contents) + header.Linkname
+	}
+
+	want := map[string]string{
+		"dir/":       "",
+		"dir/empty/": "",
+		"dir/file":   "contents",
+		"dir/link":   "file",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMoveArchiveMembers(t *testing.T) {
+	root := t.TempDir()
+	archive := filepath.Join(root, "archive.tar")
+	writeTestTar(t, archive, []archiveEntry{{name: "file", body: "contents"}})
+
+	items := map[string]bool{filepath.Join(archive, "file"): false}
+	if err := moveItems(newFilesystems(), items, root); !errors.Is(err, errReadOnlyArchive) {
+		t.Errorf("got %v, want %v", err, errReadOnlyArchive)
+	}
+
+	if _, err := os.Lstat(filepath.Join(root, "file")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("member copied out of the archive: %v", err)
+	}
+}
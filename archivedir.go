@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errReadOnlyArchive = errors.New("archives are read-only")
+
+type archiveMember struct {
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	target   string   // Of symbolic links
+	children []string // Of directories
+}
+
+// The members of an archive, keyed by their slash separated path within it.
+// The root of the archive is the member "".
+type archiveIndex struct {
+	modTime time.Time
+	size    int64
+	members map[string]*archiveMember
+}
+
+// Listing an archive means reading through all of it, so do that only once
+// for every version of it
+var archiveIndexes = make(map[string]*archiveIndex)
+
+func cleanMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Returns the member, adding it and any of its missing parents as directories,
+// since archives don't always have entries for those
+func (index *archiveIndex) member(name string) *archiveMember {
+	if member, ok := index.members[name]; ok {
+		return member
+	}
+
+	member := &archiveMember{mode: fs.ModeDir | 0755}
+	index.members[name] = member
+
+	if name != "" {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+
+		dir := index.member(parent)
+		dir.children = append(dir.children, path.Base(name))
+	}
+
+	return member
+}
+
+func (index *archiveIndex) add(name string, info fs.FileInfo, target string) {
+	name = cleanMemberName(name)
+	if name == "" {
+		return
+	}
+
+	member := index.member(name)
+	member.mode = info.Mode()
+	member.size = info.Size()
+	member.modTime = info.ModTime()
+	member.target = target
+}
+
+// Follows the symbolic links within the name, as long as they stay within the
+// archive, returning the name of the member it refers to
+func (index *archiveIndex) resolve(name string) (string, bool) {
+	resolved := ""
+	parts := strings.Split(name, "/")
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		member, ok := index.members[next]
+		if !ok {
+			return "", false
+		}
+
+		if member.mode&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		target := path.Join(resolved, member.target)
+		if hops > 40 || path.IsAbs(member.target) || target == ".." || strings.HasPrefix(target, "../") {
+			return "", false
+		}
+
+		parts = append(strings.Split(target, "/"), parts...)
+		resolved = ""
+	}
+
+	return resolved, true
+}
+
+func readTarIndex(index *archiveIndex, archive string, format int) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := openTar(file, format)
+	if err != nil {
+		return err
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		index.add(header.Name, header.FileInfo(), header.Linkname)
+	}
+}
+
+func readZipIndex(index *archiveIndex, archive string) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		var target string
+		if file.Mode()&fs.ModeSymlink != 0 {
+			src, err := file.Open()
+			if err != nil {
+				return err
+			}
+
+			link, err := io.ReadAll(src)
+			src.Close()
+			if err != nil {
+				return err
+			}
+			target = string(link)
+		}
+
+		index.add(file.Name, file.FileInfo(), target)
+	}
+
+	return nil
+}
+
+func loadArchiveIndex(archive string) (*archiveIndex, error) {
+	info, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if index, ok := archiveIndexes[archive]; ok && index.modTime.Equal(info.ModTime()) && index.size == info.Size() {
+		return index, nil
+	}
+
+	index := &archiveIndex{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		members: make(map[string]*archiveMember),
+	}
+	index.member("")
+
+	format, _ := archiveFormat(filepath.Base(archive))
+	if format == ARCHIVE_ZIP {
+		err = readZipIndex(index, archive)
+	} else {
+		err = readTarIndex(index, archive, format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	archiveIndexes[archive] = index
+	return index, nil
+}
+
+// Splits a path into the archive containing it and the slash separated name
+// of the member within that archive. The archive itself is the member "".
+func splitArchivePath(fullPath string) (string, string, bool) {
+	for archive := fullPath; archive != filepath.Dir(archive); archive = filepath.Dir(archive) {
+		if format, _ := archiveFormat(filepath.Base(archive)); format == ARCHIVE_NONE {
+			continue
+		}
+
+		if info, err := os.Stat(archive); err == nil && info.Mode().IsRegular() {
+			member := strings.TrimPrefix(fullPath[len(archive):], string(filepath.Separator))
+			return archive, filepath.ToSlash(member), true
+		}
+	}
+
+	return "", "", false
+}
+
+func isArchiveMember(fullPath string) bool {
+	_, member, ok := splitArchivePath(fullPath)
+	return ok && member != ""
+}
+
+func listArchive(archive, name string) ([]Item, error) {
+	index, err := loadArchiveIndex(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, ok := index.resolve(name)
+	dir := index.members[resolved]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: filepath.Join(archive, name), Err: fs.ErrNotExist}
+	} else if !dir.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: filepath.Join(archive, name), Err: syscall.ENOTDIR}
+	}
+
+	items := make([]Item, len(dir.children))
+	for i, child := range dir.children {
+		member := index.members[path.Join(resolved, child)]
+
+		items[i] = Item{
+			name:  child,
+			path:  filepath.Join(archive, filepath.FromSlash(path.Join(name, child))),
+			isDir: member.mode.IsDir(),
+			mode:  member.mode,
+		}
+
+		if member.mode&fs.ModeSymlink != 0 {
+			item := &items[i]
+			item.isLink = true
+			item.target = member.target
+
+			// Only links to other members of the archive can be followed
+			if target, ok := index.resolve(path.Join(resolved, child)); ok {
+				item.isDir = index.members[target].mode.IsDir()
+				item.targetMode = index.members[target].mode
+			} else {
+				item.isBroken = true
+			}
+		}
+	}
+
+	sortItems(items)
+	return items, nil
+}
+
+// Resolves the links leading up to the member, and also the member itself
+// when follow is set
+func resolveArchivePath(fullPath string, follow bool) (string, string, error) {
+	archive, member, _ := splitArchivePath(fullPath)
+	index, err := loadArchiveIndex(archive)
+	if err != nil {
+		return "", "", err
+	}
+
+	name := member
+	if !follow {
+		name = path.Dir(member)
+	}
+
+	resolved, ok := index.resolve(name)
+	if !ok {
+		return "", "", &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrNotExist}
+	}
+
+	if !follow {
+		resolved = path.Join(resolved, path.Base(member))
+	}
+	return archive, resolved, nil
+}
+
+type archiveFileInfo struct {
+	name   string
+	member *archiveMember
+}
+
+func (info archiveFileInfo) Name() string       { return info.name }
+func (info archiveFileInfo) Size() int64        { return info.member.size }
+func (info archiveFileInfo) Mode() fs.FileMode  { return info.member.mode }
+func (info archiveFileInfo) ModTime() time.Time { return info.member.modTime }
+func (info archiveFileInfo) IsDir() bool        { return info.member.mode.IsDir() }
+func (info archiveFileInfo) Sys() any           { return nil }
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+func openZipMember(archive, member string) (io.ReadCloser, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range reader.File {
+		if cleanMemberName(file.Name) == member && file.Mode().IsRegular() {
+			src, err := file.Open()
+			if err != nil {
+				reader.Close()
+				return nil, err
+			}
+
+			return readCloser{src, func() error {
+				src.Close()
+				return reader.Close()
+			}}, nil
+		}
+	}
+
+	reader.Close()
+	return nil, &fs.PathError{Op: "open", Path: filepath.Join(archive, member), Err: fs.ErrNotExist}
+}
+
+func openTarMember(archive, member string, format int) (io.ReadCloser, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openTar(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if cleanMemberName(header.Name) == member && header.Typeflag == tar.TypeReg {
+			return readCloser{reader, file.Close}, nil
+		}
+	}
+
+	file.Close()
+	return nil, &fs.PathError{Op: "open", Path: filepath.Join(archive, member), Err: fs.ErrNotExist}
+}
+
+// The members of an archive, which cannot be modified
+type archiveFilesystem struct {
+	archive string
+}
+
+func (a archiveFilesystem) member(fullPath string) string {
+	return filepath.ToSlash(strings.TrimPrefix(fullPath[len(a.archive):], string(filepath.Separator)))
+}
+
+func (a archiveFilesystem) List(path string) ([]Item, error) {
+	return listArchive(a.archive, a.member(path))
+}
+
+func (a archiveFilesystem) Stat(fullPath string) (fs.FileInfo, error) {
+	archive, member, err := resolveArchivePath(fullPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadArchiveIndex(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	info, ok := index.members[member]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: fullPath, Err: fs.ErrNotExist}
+	}
+
+	return archiveFileInfo{name: path.Base(member), member: info}, nil
+}
+
+func (a archiveFilesystem) Open(fullPath string) (io.ReadCloser, error) {
+	archive, member, err := resolveArchivePath(fullPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	format, _ := archiveFormat(filepath.Base(archive))
+	if format == ARCHIVE_ZIP {
+		return openZipMember(archive, member)
+	}
+	return openTarMember(archive, member, format)
+}
+
+func (archiveFilesystem) Create(string, int, fs.FileMode) (io.WriteCloser, error) {
+	return nil, errReadOnlyArchive
+}
+
+func (archiveFilesystem) Mkdir(string, fs.FileMode) error {
+	return errReadOnlyArchive
+}
+
+func (archiveFilesystem) Rename(string, string) error {
+	return errReadOnlyArchive
+}
+
+func (archiveFilesystem) Remove(string) error {
+	return errReadOnlyArchive
+}
+
+func (archiveFilesystem) Symlink(string, string) error {
+	return errReadOnlyArchive
+}
+
+func (a archiveFilesystem) Readlink(fullPath string) (string, error) {
+	info, err := a.Stat(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	member := info.(archiveFileInfo).member
+	if member.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: fullPath, Err: errors.New("not a symbolic link")}
+	}
+	return member.target, nil
+}
+
+// Archives are browsed read-only, so anything creating items in a directory
+// has to check first
+func (fm *Fm) CheckWritable(dir string) bool {
+	if _, _, ok := splitArchivePath(dir); ok {
+		fm.message = errReadOnlyArchive
+		return false
+	}
+	return true
+}
+
+// Moving items out of an archive would only copy them, so the directories
+// they are moved from have to be writable too
+func (fm *Fm) CheckMovable(items map[string]bool) bool {
+	for item := range items {
+		if !fm.CheckWritable(filepath.Dir(item)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+// Yanks the marked items, otherwise N items starting from the cursor
+func (fm *Fm) Yank(cut bool) {
+	items := make(map[string]bool)
+	if len(fm.marked) > 0 {
+		unionMarked(items, fm.marked)
+	} else if len(fm.items) > 0 {
+		last := min(fm.cursor+max(1, fm.count), len(fm.items))
+		for i := fm.cursor; i < last; i++ {
+			items[fm.items[i].path] = fm.items[i].isDir
+		}
+	} else {
+		return
+	}
+
+	if cut && !fm.CheckMovable(items) {
+		return
+	}
+
+	fm.marked = make(map[string]bool)
+	fm.clipboard = items
+	fm.clipboardCut = cut
+
+	if cut {
+		fm.notice = "Cut " + strconv.Itoa(len(items)) + " item(s)"
+	} else {
+		fm.notice = "Yanked " + strconv.Itoa(len(items)) + " item(s)"
+	}
+}
+
+// Copies can be pasted any number of times, while cuts are consumed by the
+// first paste
+func (fm *Fm) Paste() {
+	if len(fm.clipboard) == 0 {
+		fm.message = errors.New("nothing to paste")
+		return
+	}
+
+	if !fm.CheckWritable(fm.path) || (fm.clipboardCut && !fm.CheckMovable(fm.clipboard)) {
+		return
+	}
+
+	var last string
+	for item := range fm.clipboard {
+		last = filepath.Base(item)
+		break
+	}
+
+	if fm.clipboardCut {
+		fm.message = moveItems(fm.filesystems, fm.clipboard, fm.path)
+		if fm.message == nil {
+			fm.clipboard = nil
+		}
+	} else {
+		fm.message = copyItems(fm.filesystems, fm.clipboard, fm.path)
+	}
+
+	fm.Refresh()
+	fm.FindExact(last)
+}
+
+// Uses the command in $FM_CLIPBOARD (like `wl-copy` or `xclip -sel clip`) if
+// set, otherwise falls back to the OSC 52 escape sequence, which is understood
+// by most terminals and works over SSH too
+func (fm *Fm) SetSystemClipboard(text string) error {
+	if program := strings.Fields(os.Getenv("FM_CLIPBOARD")); len(program) > 0 {
+		cmd := exec.Command(program[0], program[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+
+	_, err := fm.tty.WriteString("\033]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a")
+	return err
+}
+
+// Copies the paths of the marked items, otherwise the item under the cursor, to
+// the system clipboard after transforming them with the given function. Remote
+// paths are copied as sftp:// URLs, rather than the form used within fm.
+func (fm *Fm) YankPaths(transform func(string) string) {
+	paths := []string{}
+	if len(fm.marked) > 0 {
+		paths = sortedMarked(fm.marked)
+	} else if len(fm.items) > 0 {
+		paths = append(paths, fm.items[fm.cursor].path)
+	} else {
+		return
+	}
+
+	seen := make(map[string]bool)
+	lines := []string{}
+	for _, path := range paths {
+		line := displayPath(transform(path))
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+
+	fm.message = fm.SetSystemClipboard(strings.Join(lines, "\n"))
+	if fm.message == nil {
+		fm.notice = "Copied " + strconv.Itoa(len(lines)) + " line(s) to the clipboard"
+	}
+}
+
+func (fm *Fm) YankCommand(ch gc.Key) {
+	switch ch {
+	case 'y':
+		fm.Yank(false)
+
+	case 'd':
+		fm.Yank(true)
+
+	case 'p':
+		fm.YankPaths(func(path string) string {
+			return path
+		})
+
+	case 'n':
+		fm.YankPaths(filepath.Base)
+
+	case 'P':
+		fm.YankPaths(filepath.Dir)
+
+	case 27:
+		return
+
+	default:
+		fm.message = errors.New("unknown yank command '" + gc.KeyString(ch) + "'")
+	}
+}
+
+func (fm *Fm) ClipboardStatus() string {
+	if len(fm.clipboard) == 0 {
+		return ""
+	}
+
+	if fm.clipboardCut {
+		return "Cut: " + strconv.Itoa(len(fm.clipboard)) + " item(s)"
+	}
+	return "Yanked: " + strconv.Itoa(len(fm.clipboard)) + " item(s)"
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+type Style struct {
+	attr gc.Char
+	fg   int16
+	bg   int16
+}
+
+// Color pairs beyond the fixed COLOR_* ones are allocated on demand
+var dynamicPairs = make(map[[2]int16]int16)
+
+func colorPair(fg, bg int16) int16 {
+	key := [2]int16{fg, bg}
+	if pair, ok := dynamicPairs[key]; ok {
+		return pair
+	}
+
+	// Color pairs have to fit in the attributes of a narrow character
+	pair := int16(COLOR_COUNT + len(dynamicPairs))
+	if int(pair) >= min(gc.ColorPairs(), 256) {
+		return 0
+	}
+
+	gc.InitPair(pair, fitColor(fg), fitColor(bg))
+	dynamicPairs[key] = pair
+	return pair
+}
+
+// Needs to be called whenever the terminal is reinitialized
+func initDynamicPairs() {
+	for key, pair := range dynamicPairs {
+		gc.InitPair(pair, fitColor(key[0]), fitColor(key[1]))
+	}
+}
+
+func (s Style) Pair() int16 {
+	if !s.HasColor() {
+		return 0
+	}
+
+	return colorPair(s.fg, s.bg)
+}
+
+func rgbTo256(r, g, b int) int16 {
+	if r == g && g == b {
+		if r < 8 {
+			return 16
+		}
+
+		if r > 248 {
+			return 231
+		}
+
+		return int16(232 + (r-8)*24/247)
+	}
+
+	cube := func(v int) int {
+		if v < 48 {
+			return 0
+		}
+
+		if v < 115 {
+			return 1
+		}
+
+		return (v - 35) / 40
+	}
+
+	return int16(16 + 36*cube(r) + 6*cube(g) + cube(b))
+}
+
+func color256ToRGB(color int16) (int, int, int) {
+	switch {
+	case color < 16:
+		base := [16][3]int{
+			{0, 0, 0}, {128, 0, 0}, {0, 128, 0}, {128, 128, 0},
+			{0, 0, 128}, {128, 0, 128}, {0, 128, 128}, {192, 192, 192},
+			{128, 128, 128}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+			{0, 0, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+		}
+		return base[color][0], base[color][1], base[color][2]
+
+	case color < 232:
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		color -= 16
+		return levels[color/36], levels[color/6%6], levels[color%6]
+
+	default:
+		v := 8 + int(color-232)*10
+		return v, v, v
+	}
+}
+
+// Degrades a color to one supported by the terminal
+func fitColor(color int16) int16 {
+	colors := gc.Colors()
+	if color < 0 || int(color) < colors {
+		return color
+	}
+
+	if colors >= 16 && color < 16 {
+		return color
+	}
+
+	if color < 16 {
+		return color % 8
+	}
+
+	r, g, b := color256ToRGB(color)
+	if colors >= 16 {
+		if max(r, g, b) > 191 {
+			return basicColor(r, g, b) + 8
+		}
+		return basicColor(r, g, b)
+	}
+
+	return basicColor(r, g, b)
+}
+
+func basicColor(r, g, b int) int16 {
+	threshold := (max(r, g, b) + min(r, g, b)) / 2
+	if max(r, g, b)-min(r, g, b) < 32 {
+		if threshold < 64 {
+			return gc.C_BLACK
+		}
+		return gc.C_WHITE
+	}
+
+	var color int16
+	if r > threshold {
+		color |= gc.C_RED
+	}
+	if g > threshold {
+		color |= gc.C_GREEN
+	}
+	if b > threshold {
+		color |= gc.C_BLUE
+	}
+	return color
+}
+
+// Parses an ANSI Select Graphic Rendition sequence like "01;38;5;208"
+func parseSGR(sgr string) Style {
+	style := Style{fg: -1, bg: -1}
+
+	codes := strings.Split(sgr, ";")
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case code == 0:
+			style = Style{fg: -1, bg: -1}
+		case code == 1:
+			style.attr |= gc.A_BOLD
+		case code == 2:
+			style.attr |= gc.A_DIM
+		case code == 4:
+			style.attr |= gc.A_UNDERLINE
+		case code == 5:
+			style.attr |= gc.A_BLINK
+		case code == 7:
+			style.attr |= gc.A_REVERSE
+		case code >= 30 && code <= 37:
+			style.fg = int16(code - 30)
+		case code == 39:
+			style.fg = -1
+		case code >= 40 && code <= 47:
+			style.bg = int16(code - 40)
+		case code == 49:
+			style.bg = -1
+		case code >= 90 && code <= 97:
+			style.fg = int16(code - 90 + 8)
+		case code >= 100 && code <= 107:
+			style.bg = int16(code - 100 + 8)
+
+		case code == 38 || code == 48:
+			var color int16 = -1
+			if i+2 < len(codes) && codes[i+1] == "5" {
+				if n, err := strconv.Atoi(codes[i+2]); err == nil && n >= 0 && n < 256 {
+					color = int16(n)
+				}
+				i += 2
+			} else if i+4 < len(codes) && codes[i+1] == "2" {
+				r, _ := strconv.Atoi(codes[i+2])
+				g, _ := strconv.Atoi(codes[i+3])
+				b, _ := strconv.Atoi(codes[i+4])
+				color = rgbTo256(r, g, b)
+				i += 4
+			}
+
+			if code == 38 {
+				style.fg = color
+			} else {
+				style.bg = color
+			}
+		}
+	}
+
+	return style
+}
+
+type LsColors struct {
+	types      map[string]Style
+	extensions []string // Lowercased, longest match wins
+	extStyles  map[string]Style
+	linkTarget bool // Links are colored like their targets, from "ln=target"
+}
+
+// Parses the format of the LS_COLORS environment variable, as documented in
+// dircolors(1)
+func parseLsColors(value string) LsColors {
+	colors := LsColors{
+		types:     make(map[string]Style),
+		extStyles: make(map[string]Style),
+	}
+
+	for _, entry := range strings.Split(value, ":") {
+		key, sgr, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			continue
+		}
+
+		if key == "ln" && sgr == "target" {
+			colors.linkTarget = true
+			delete(colors.types, key)
+		} else if strings.HasPrefix(key, "*") {
+			ext := strings.ToLower(key[1:])
+			if _, ok := colors.extStyles[ext]; !ok {
+				colors.extensions = append(colors.extensions, ext)
+			}
+			colors.extStyles[ext] = parseSGR(sgr)
+		} else {
+			colors.types[key] = parseSGR(sgr)
+			if key == "ln" {
+				colors.linkTarget = false
+			}
+		}
+	}
+
+	return colors
+}
+
+func (c LsColors) Lookup(item Item) (Style, bool) {
+	if item.isBroken {
+		if style, ok := c.types["or"]; ok {
+			return style, true
+		}
+	}
+
+	if item.isLink && !item.isBroken && c.linkTarget {
+		target := item
+		target.isLink = false
+		target.mode = item.targetMode
+		target.name = filepath.Base(item.target)
+		return c.Lookup(target)
+	}
+
+	var key string
+	switch mode := item.mode; {
+	case mode&fs.ModeSymlink != 0:
+		key = "ln"
+
+	case mode.IsDir():
+		switch {
+		case mode&fs.ModeSticky != 0 && mode&0002 != 0:
+			key = "tw"
+		case mode&0002 != 0:
+			key = "ow"
+		case mode&fs.ModeSticky != 0:
+			key = "st"
+		default:
+			key = "di"
+		}
+
+	case mode&fs.ModeNamedPipe != 0:
+		key = "pi"
+
+	case mode&fs.ModeSocket != 0:
+		key = "so"
+
+	case mode&fs.ModeCharDevice != 0:
+		key = "cd"
+
+	case mode&fs.ModeDevice != 0:
+		key = "bd"
+
+	case mode&fs.ModeSetuid != 0:
+		key = "su"
+
+	case mode&fs.ModeSetgid != 0:
+		key = "sg"
+
+	case mode&0111 != 0:
+		key = "ex"
+	}
+
+	// Special directories fall back to the plain directory style, and so do
+	// setuid and setgid executables to the executable style
+	fallbacks := map[string]string{"tw": "di", "ow": "di", "st": "di", "su": "ex", "sg": "ex"}
+	for key != "" {
+		if style, ok := c.types[key]; ok {
+			return style, true
+		}
+		key = fallbacks[key]
+	}
+
+	if item.mode.IsRegular() {
+		name := strings.ToLower(item.name)
+		best := ""
+		for _, ext := range c.extensions {
+			if len(ext) > len(best) && strings.HasSuffix(name, ext) {
+				best = ext
+			}
+		}
+
+		if best != "" {
+			return c.extStyles[best], true
+		}
+
+		if style, ok := c.types["fi"]; ok {
+			return style, true
+		}
+	}
+
+	return Style{}, false
+}
+
+func (fm *Fm) ItemStyle(item Item) (gc.Char, int16) {
+	if style, ok := fm.lsColors.Lookup(item); ok {
+		return style.attr, style.Pair()
+	}
+
+	element := itemColor(item)
+	if !fm.theme[element].HasColor() {
+		return fm.theme[element].attr, 0
+	}
+
+	return fm.theme[element].attr, element
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+// Takes the text before the cursor, and returns the candidates to replace it
+// with
+type Completer func(prefix string) []string
+
+func longestCommonPrefix(items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+
+	prefix := items[0]
+	for _, item := range items[1:] {
+		for !strings.HasPrefix(item, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	// Don't split multibyte characters
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	return prefix
+}
+
+// Resolves a path typed into a prompt. Paths starting with "~/" are within the
+// home directory, and absolute paths are taken as is, on the same host when
+// browsing a remote one. Everything else is relative to the current directory.
+func (fm *Fm) ExpandPath(input string) string {
+	if host, _, ok := splitRemotePath(fm.path); ok {
+		if filepath.IsAbs(input) {
+			return remotePath(host, input)
+		}
+		return filepath.Join(fm.path, input)
+	}
+
+	if input == "~" || strings.HasPrefix(input, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, input[1:])
+		}
+	}
+
+	if filepath.IsAbs(input) {
+		return filepath.Clean(input)
+	}
+	return filepath.Join(fm.path, input)
+}
+
+// Puts the cursor on the item containing the path, if it is within the
+// current directory
+func (fm *Fm) FindContaining(path string) {
+	rel, err := filepath.Rel(fm.path, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return
+	}
+
+	first, _, _ := strings.Cut(rel, "/")
+	fm.FindExact(first)
+}
+
+// Completes paths relative to the current directory. Directories are completed
+// with a trailing slash, so that completion can continue into them.
+func (fm *Fm) CompletePath(prefix string) []string {
+	dirPart, base := "", prefix
+	if index := strings.LastIndexByte(prefix, '/'); index != -1 {
+		dirPart, base = prefix[:index+1], prefix[index+1:]
+	}
+
+	items, err := fm.filesystems.List(fm.ExpandPath(dirPart))
+	if err != nil {
+		return nil
+	}
+
+	candidates := []string{}
+	for _, item := range items {
+		if !strings.HasPrefix(item.name, base) {
+			continue
+		}
+
+		// Hidden items are only completed when asked for explicitly
+		if strings.HasPrefix(item.name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		candidate := dirPart + item.name
+		if item.isDir {
+			candidate += "/"
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// Completes executables in $PATH, unless the program is a path itself
+func (fm *Fm) CompleteProgram(prefix string) []string {
+	if strings.ContainsRune(prefix, '/') {
+		return fm.CompletePath(prefix)
+	}
+
+	seen := make(map[string]bool)
+	candidates := []string{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if seen[name] || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+
+			seen[name] = true
+			candidates = append(candidates, name)
+		}
+	}
+
+	sort.Strings(candidates)
+	return candidates
+}
+
+// The state of completion within a prompt. Pressing Tab first inserts the
+// longest common prefix of the candidates, and then cycles through them in a
+// menu shown above the prompt.
+type Completion struct {
+	complete   Completer
+	candidates []string
+	index      int
+}
+
+func (c *Completion) Active() bool {
+	return c.candidates != nil
+}
+
+func (c *Completion) Reset() {
+	c.candidates = nil
+}
+
+func (c *Completion) Next(input *Line, step int) {
+	if c.Active() {
+		c.index = (c.index + step + len(c.candidates)) % len(c.candidates)
+		input.ReplaceBeforeCursor(c.candidates[c.index])
+		return
+	}
+
+	prefix := string(input.buffer[:input.cursor])
+	candidates := c.complete(prefix)
+	if len(candidates) == 0 {
+		return
+	}
+
+	if len(candidates) == 1 {
+		input.ReplaceBeforeCursor(candidates[0])
+		return
+	}
+
+	if common := longestCommonPrefix(candidates); len(common) > len(prefix) {
+		input.ReplaceBeforeCursor(common)
+		return
+	}
+
+	c.candidates = candidates
+	c.index = 0
+	if step < 0 {
+		c.index = len(candidates) - 1
+	}
+	input.ReplaceBeforeCursor(c.candidates[c.index])
+}
+
+func completionLabel(candidate string) string {
+	trimmed := strings.TrimSuffix(candidate, "/")
+	label := trimmed[strings.LastIndexByte(trimmed, '/')+1:]
+	if trimmed != candidate {
+		label += "/"
+	}
+	return label
+}
+
+// Draws the candidates right above the prompt in the last line
+func (fm *Fm) DrawCompletion(c *Completion) {
+	height, width := fm.window.MaxYX()
+
+	rows := min(len(c.candidates), (height-1)/2)
+	if rows <= 0 {
+		return
+	}
+
+	start := max(min(c.index-rows/2, len(c.candidates)-rows), 0)
+	top := height - 2 - rows
+
+	fm.StyleOn(COLOR_BORDER)
+	fm.window.HLine(top, 0, gc.ACS_HLINE, width)
+	fm.StyleOff(COLOR_BORDER)
+
+	for i := 0; i < rows; i++ {
+		index := start + i
+		fm.window.Move(top+1+i, 0)
+		fm.window.ClearToEOL()
+
+		if index == c.index {
+			fm.StyleOn(COLOR_CURSOR)
+		}
+
+		fm.window.Print(truncateWidth(completionLabel(c.candidates[index]), width-1))
+
+		if index == c.index {
+			fm.StyleOff(COLOR_CURSOR)
+		}
+	}
+}
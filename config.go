@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func configDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "fm"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".config", "fm"), nil
+}
+
+// Maps section names to the key value pairs within them. Keys outside of any
+// section live in the section "".
+type Config map[string]map[string]string
+
+// The configuration is an INI-esque file at $XDG_CONFIG_HOME/fm/config
+//
+//	# Comment
+//	[section]
+//	key = value
+func loadConfig() (Config, error) {
+	config := Config{"": {}}
+
+	dir, err := configDir()
+	if err != nil {
+		return config, err
+	}
+
+	path := filepath.Join(dir, "config")
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := config[section]; !ok {
+				config[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return config, fmt.Errorf("%s:%d: expected 'key = value'", path, row)
+		}
+
+		config[section][strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return config, scanner.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Expands the braces in the pattern like a shell, so "{a,b}.txt" becomes
+// "a.txt" and "b.txt". Braces without a comma at the top level are literal.
+func expandBraces(pattern string) []string {
+	open := -1
+	depth := 0
+	commas := []int{}
+
+	for i, ch := range pattern {
+		switch ch {
+		case '{':
+			if depth == 0 {
+				open = i
+				commas = commas[:0]
+			}
+			depth++
+
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+
+		case '}':
+			if depth == 0 {
+				continue
+			}
+
+			depth--
+			if depth != 0 || len(commas) == 0 {
+				continue
+			}
+
+			prefix, suffix := pattern[:open], pattern[i+1:]
+			bounds := append([]int{open}, commas...)
+			bounds = append(bounds, i)
+
+			expanded := []string{}
+			for j := 0; j+1 < len(bounds); j++ {
+				alternative := pattern[bounds[j]+1 : bounds[j+1]]
+				for _, tail := range expandBraces(alternative + suffix) {
+					expanded = append(expanded, prefix+tail)
+				}
+			}
+
+			return expanded
+		}
+	}
+
+	return []string{pattern}
+}
+
+func templatesDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "templates"), nil
+}
+
+// Templates are named after the extension they apply to, like "go" for "*.go"
+// or "tar.gz" for "*.tar.gz". The longest extension wins.
+func findTemplate(name string) (string, bool) {
+	dir, err := templatesDir()
+	if err != nil {
+		return "", false
+	}
+
+	for ext := name; ; {
+		index := strings.IndexByte(ext[1:], '.')
+		if index == -1 {
+			return "", false
+		}
+
+		ext = ext[index+2:]
+		path := filepath.Join(dir, ext)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, true
+		}
+	}
+}
+
+// Creates the file along with any missing parent directories. Existing files
+// are left untouched, and new files are filled in from the template for their
+// extension, if any.
+func createFile(filesystem Filesystem, path string) error {
+	if err := filesystem.Mkdir(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	mode := fs.FileMode(0644)
+	template, hasTemplate := findTemplate(filepath.Base(path))
+
+	var contents []byte
+	if hasTemplate {
+		info, err := os.Stat(template)
+		if err != nil {
+			return err
+		}
+
+		// Executable templates, like shell scripts, produce executable files
+		mode |= info.Mode().Perm() & 0111
+
+		contents, err = os.ReadFile(template)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := filesystem.Create(path, os.O_EXCL, mode)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (fm *Fm) Create(query string, dir bool) {
+	names := expandBraces(query)
+	for _, name := range names {
+		path := fm.ExpandPath(name)
+		if dir {
+			fm.message = fm.filesystems.For(path).Mkdir(path, 0750)
+		} else {
+			fm.message = createFile(fm.filesystems.For(path), path)
+		}
+
+		if fm.message != nil {
+			break
+		}
+	}
+
+	fm.Refresh()
+	fm.FindContaining(fm.ExpandPath(names[0]))
+}
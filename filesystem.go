@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Everything done to items goes through the filesystem they live in, so that
+// they don't have to be on the local disk
+type Filesystem interface {
+	List(path string) ([]Item, error)
+	Stat(path string) (fs.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+
+	// The flag is added to os.O_WRONLY|os.O_CREATE, like os.O_EXCL or os.O_TRUNC
+	Create(path string, flag int, perm fs.FileMode) (io.WriteCloser, error)
+
+	Mkdir(path string, perm fs.FileMode) error // Along with any missing parents
+	Rename(oldPath, newPath string) error
+	Remove(path string) error // Along with everything within it
+	Symlink(target, path string) error
+	Readlink(path string) (string, error)
+}
+
+// The filesystems items live in, by the directories they are mounted on.
+// Remote hosts are mounted when first visited, archives on the local disk are
+// browsed where they are, and everything else is on the local disk.
+type Filesystems struct {
+	mounts map[string]Filesystem
+}
+
+func newFilesystems() *Filesystems {
+	return &Filesystems{mounts: make(map[string]Filesystem)}
+}
+
+// Everything within the directory lives in the filesystem from now on
+func (f *Filesystems) Mount(dir string, filesystem Filesystem) {
+	f.mounts[filepath.Clean(dir)] = filesystem
+}
+
+// Returns the filesystem the items within the directory live in
+func (f *Filesystems) Within(dir string) Filesystem {
+	for mount := dir; ; mount = filepath.Dir(mount) {
+		if filesystem, ok := f.mounts[mount]; ok {
+			return filesystem
+		}
+
+		if mount == filepath.Dir(mount) {
+			break
+		}
+	}
+
+	if host, _, ok := splitRemotePath(dir); ok {
+		return f.remote(host)
+	}
+
+	if archive, _, ok := splitArchivePath(dir); ok {
+		return archiveFilesystem{archive: archive}
+	}
+
+	return localFilesystem{}
+}
+
+// Returns the filesystem the item lives in. The root of an archive lives in
+// the filesystem containing the archive, not in the archive itself.
+func (f *Filesystems) For(path string) Filesystem {
+	return f.Within(filepath.Dir(path))
+}
+
+func (f *Filesystems) IsLocal(path string) bool {
+	_, ok := f.For(path).(localFilesystem)
+	return ok
+}
+
+func (f *Filesystems) List(dir string) ([]Item, error) {
+	return f.Within(dir).List(dir)
+}
+
+func (f *Filesystems) remote(host string) *sftpFilesystem {
+	root := remotePath(host, "/")
+	if filesystem, ok := f.mounts[root].(*sftpFilesystem); ok {
+		return filesystem
+	}
+
+	filesystem := &sftpFilesystem{host: host}
+	f.mounts[root] = filesystem
+	return filesystem
+}
+
+// Closes the connections to remote hosts
+func (f *Filesystems) Close() {
+	for _, filesystem := range f.mounts {
+		if closer, ok := filesystem.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Copies files and directories, along with everything within them, between
+// any two filesystems. Symbolic links are copied as links like "cp -r" does,
+// since following links to directories containing them would never end.
+func copyTree(filesystems *Filesystems, src, dst string) error {
+	info, err := filesystems.For(src).Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := filesystems.For(src).Readlink(src)
+		if err != nil {
+			return err
+		}
+		return filesystems.For(dst).Symlink(target, dst)
+	}
+
+	if !info.IsDir() {
+		return copyFile(filesystems, src, dst)
+	}
+
+	if strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		return errors.New("cannot copy '" + filepath.Base(src) + "' into itself")
+	}
+
+	if err := filesystems.For(dst).Mkdir(dst, 0750); err != nil {
+		return err
+	}
+
+	items, err := filesystems.List(src)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := copyTree(filesystems, item.path, filepath.Join(dst, item.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Items not on the local disk are copied to a temporary directory to be
+// opened, which is cleaned up on exit since the opened program may outlive
+// fm.Enter()
+func (fm *Fm) TemporaryCopy(fullPath string) (string, error) {
+	if fm.tempDir == "" {
+		dir, err := os.MkdirTemp("", "fm-")
+		if err != nil {
+			return "", err
+		}
+		fm.tempDir = dir
+	}
+
+	dest, err := os.MkdirTemp(fm.tempDir, "")
+	if err != nil {
+		return "", err
+	}
+
+	if !isArchiveMember(fullPath) {
+		dst := filepath.Join(dest, filepath.Base(fullPath))
+		return dst, copyFile(fm.filesystems, fullPath, dst)
+	}
+
+	archive, member, err := resolveArchivePath(fullPath, true)
+	if err != nil {
+		return "", err
+	}
+
+	if err := extractMembers(context.Background(), archive, member, dest, &Progress{}); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dest, filepath.Base(filepath.FromSlash(member))), nil
+}
+
+type localFilesystem struct{}
+
+func (localFilesystem) List(path string) ([]Item, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, len(entries))
+	for index, entry := range entries {
+		items[index] = Item{
+			name:  entry.Name(),
+			path:  filepath.Join(path, entry.Name()),
+			isDir: entry.IsDir(),
+			mode:  entry.Type(),
+		}
+
+		if info, err := entry.Info(); err == nil {
+			items[index].mode = info.Mode()
+		}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			item := &items[index]
+			item.isLink = true
+			item.target, _ = os.Readlink(item.path)
+
+			if info, err := os.Stat(item.path); err == nil {
+				item.isDir = info.IsDir()
+				item.targetMode = info.Mode()
+			} else {
+				item.isBroken = true
+			}
+		}
+	}
+
+	sortItems(items)
+	return items, nil
+}
+
+func (localFilesystem) Stat(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localFilesystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localFilesystem) Create(path string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, perm)
+}
+
+func (localFilesystem) Mkdir(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (localFilesystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (localFilesystem) Remove(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (localFilesystem) Symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (localFilesystem) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memNode struct {
+	mode   fs.FileMode
+	data   []byte
+	target string // Of symbolic links
+}
+
+// A filesystem kept entirely in memory, so that operations on items can be
+// tested without touching the disk
+type memFilesystem struct {
+	nodes map[string]*memNode
+}
+
+func newMemFilesystem() *memFilesystem {
+	return &memFilesystem{nodes: map[string]*memNode{"/": {mode: fs.ModeDir | 0755}}}
+}
+
+type memInfo struct {
+	name string
+	node *memNode
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.node.data)) }
+func (i memInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+func memError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// Follows symbolic links when asked to, like os.Stat
+func (m *memFilesystem) lookup(path string, follow bool) (*memNode, error) {
+	path = filepath.Clean(path)
+	for i := 0; i < 16; i++ {
+		node, ok := m.nodes[path]
+		if !ok {
+			return nil, memError("stat", path, fs.ErrNotExist)
+		}
+
+		if !follow || node.mode&fs.ModeSymlink == 0 {
+			return node, nil
+		}
+
+		target := node.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+	}
+	return nil, memError("stat", path, errors.New("too many levels of symbolic links"))
+}
+
+func (m *memFilesystem) checkParent(op, path string) error {
+	parent, err := m.lookup(filepath.Dir(path), true)
+	if err != nil {
+		return memError(op, path, fs.ErrNotExist)
+	}
+
+	if !parent.mode.IsDir() {
+		return memError(op, path, errors.New("not a directory"))
+	}
+	return nil
+}
+
+func (m *memFilesystem) List(path string) ([]Item, error) {
+	dir, err := m.lookup(path, true)
+	if err != nil {
+		return nil, err
+	} else if !dir.mode.IsDir() {
+		return nil, memError("readdir", path, errors.New("not a directory"))
+	}
+
+	items := []Item{}
+	for child, node := range m.nodes {
+		if child == "/" || filepath.Dir(child) != filepath.Clean(path) {
+			continue
+		}
+
+		item := Item{
+			name:  filepath.Base(child),
+			path:  child,
+			isDir: node.mode.IsDir(),
+			mode:  node.mode,
+		}
+
+		if node.mode&fs.ModeSymlink != 0 {
+			item.isLink = true
+			item.target = node.target
+
+			if target, err := m.lookup(child, true); err == nil {
+				item.isDir = target.mode.IsDir()
+				item.targetMode = target.mode
+			} else {
+				item.isBroken = true
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	sortItems(items)
+	return items, nil
+}
+
+func (m *memFilesystem) Stat(path string) (fs.FileInfo, error) {
+	node, err := m.lookup(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return memInfo{name: filepath.Base(path), node: node}, nil
+}
+
+func (m *memFilesystem) Open(path string) (io.ReadCloser, error) {
+	node, err := m.lookup(path, true)
+	if err != nil {
+		return nil, err
+	} else if node.mode.IsDir() {
+		return nil, memError("open", path, errors.New("is a directory"))
+	}
+	return io.NopCloser(bytes.NewReader(node.data)), nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	node *memNode
+}
+
+func (w *memWriter) Close() error {
+	w.node.data = w.Bytes()
+	return nil
+}
+
+func (m *memFilesystem) Create(path string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := m.checkParent("open", path); err != nil {
+		return nil, err
+	}
+
+	node, err := m.lookup(path, true)
+	if err == nil {
+		if flag&os.O_EXCL != 0 {
+			return nil, memError("open", path, fs.ErrExist)
+		} else if node.mode.IsDir() {
+			return nil, memError("open", path, errors.New("is a directory"))
+		}
+	} else {
+		node = &memNode{mode: perm}
+		m.nodes[filepath.Clean(path)] = node
+	}
+
+	return &memWriter{node: node}, nil
+}
+
+func (m *memFilesystem) Mkdir(path string, perm fs.FileMode) error {
+	path = filepath.Clean(path)
+	if node, err := m.lookup(path, true); err == nil {
+		if !node.mode.IsDir() {
+			return memError("mkdir", path, errors.New("not a directory"))
+		}
+		return nil
+	}
+
+	if err := m.Mkdir(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+
+	m.nodes[path] = &memNode{mode: fs.ModeDir | perm}
+	return nil
+}
+
+// Moves the node along with everything within it
+func (m *memFilesystem) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	if _, ok := m.nodes[oldPath]; !ok {
+		return memError("rename", oldPath, fs.ErrNotExist)
+	}
+
+	if err := m.checkParent("rename", newPath); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		return memError("rename", oldPath, errors.New("invalid argument"))
+	}
+
+	for path, node := range m.nodes {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			delete(m.nodes, path)
+			m.nodes[newPath+path[len(oldPath):]] = node
+		}
+	}
+	return nil
+}
+
+func (m *memFilesystem) Remove(path string) error {
+	path = filepath.Clean(path)
+	for child := range m.nodes {
+		if child == path || strings.HasPrefix(child, path+"/") {
+			delete(m.nodes, child)
+		}
+	}
+	return nil
+}
+
+func (m *memFilesystem) Symlink(target, path string) error {
+	if err := m.checkParent("symlink", path); err != nil {
+		return err
+	}
+
+	if _, ok := m.nodes[filepath.Clean(path)]; ok {
+		return memError("symlink", path, fs.ErrExist)
+	}
+
+	m.nodes[filepath.Clean(path)] = &memNode{mode: fs.ModeSymlink | 0777, target: target}
+	return nil
+}
+
+func (m *memFilesystem) Readlink(path string) (string, error) {
+	node, err := m.lookup(path, false)
+	if err != nil {
+		return "", err
+	} else if node.mode&fs.ModeSymlink == 0 {
+		return "", memError("readlink", path, errors.New("invalid argument"))
+	}
+	return node.target, nil
+}
+
+// Creates the files with the given contents, and the directories ending with
+// a slash
+func (m *memFilesystem) populate(t *testing.T, files map[string]string) {
+	for path, contents := range files {
+		if strings.HasSuffix(path, "/") {
+			if err := m.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		if err := m.Mkdir(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := m.Create(path, os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(contents))
+		file.Close()
+	}
+}
+
+func (m *memFilesystem) contents(t *testing.T, path string) string {
+	file, err := m.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (m *memFilesystem) exists(path string) bool {
+	_, err := m.Stat(path)
+	return err == nil
+}
+
+func newMemFilesystems() (*Filesystems, *memFilesystem) {
+	mem := newMemFilesystem()
+	filesystems := newFilesystems()
+	filesystems.Mount("/", mem)
+	return filesystems, mem
+}
+
+func TestFilesystemsWithin(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	other := newMemFilesystem()
+	filesystems.Mount("/mnt/other", other)
+
+	tests := []struct {
+		dir  string
+		want Filesystem
+	}{
+		{"/", mem},
+		{"/home/user", mem},
+		{"/mnt", mem},
+		{"/mnt/other", other},
+		{"/mnt/other/dir", other},
+		{"/mnt/otherwise", mem},
+	}
+
+	for _, test := range tests {
+		if got := filesystems.Within(test.dir); got != test.want {
+			t.Errorf("Within(%q) = %v, want %v", test.dir, got, test.want)
+		}
+	}
+
+	remote, ok := filesystems.Within(remotePath("user@host", "/srv")).(*sftpFilesystem)
+	if !ok || remote.host != "user@host" {
+		t.Fatalf("remote directory not within its host, got %v", remote)
+	}
+
+	if filesystems.Within(remotePath("user@host", "/")) != remote {
+		t.Error("the same host was mounted twice")
+	}
+
+	if filesystems.IsLocal("/file") {
+		t.Error("items in memory reported as local")
+	}
+}
+
+func TestCopyItems(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{
+		"/src/file":         "file",
+		"/src/dir/nested":   "nested",
+		"/src/dir/empty/":   "",
+		"/dst/":             "",
+		"/dst/file.orig":    "untouched",
+		"/src/dir/sub/deep": "deep",
+	})
+
+	items := map[string]bool{"/src/file": false, "/src/dir": true}
+	if err := copyItems(filesystems, items, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/dst/file":         "file",
+		"/dst/dir/nested":   "nested",
+		"/dst/dir/sub/deep": "deep",
+		"/src/file":         "file",
+		"/dst/file.orig":    "untouched",
+	} {
+		if got := mem.contents(t, path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	if info, err := mem.Stat("/dst/dir/empty"); err != nil || !info.IsDir() {
+		t.Errorf("empty directory not copied: %v", err)
+	}
+
+	if err := copyItems(filesystems, map[string]bool{"/src/file": false}, "/src"); err == nil {
+		t.Error("copying an item onto itself succeeded")
+	}
+
+	if err := copyItems(filesystems, map[string]bool{"/src": true}, "/src/dir"); err == nil {
+		t.Error("copying a directory into itself succeeded")
+	}
+}
+
+func TestMoveItems(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	other := newMemFilesystem()
+	filesystems.Mount("/mnt", other)
+	other.populate(t, map[string]string{"/mnt/": ""})
+	mem.populate(t, map[string]string{
+		"/src/file":       "file",
+		"/src/dir/nested": "nested",
+		"/dst/":           "",
+	})
+
+	items := map[string]bool{"/src/file": false, "/src/dir": true}
+	if err := moveItems(filesystems, items, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem.exists("/src/file") || mem.exists("/src/dir") {
+		t.Error("moved items left behind")
+	}
+
+	if got := mem.contents(t, "/dst/dir/nested"); got != "nested" {
+		t.Errorf("got %q, want %q", got, "nested")
+	}
+
+	// Between filesystems the items are copied, and then removed
+	items = map[string]bool{"/dst/file": false, "/dst/dir": true}
+	if err := moveItems(filesystems, items, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem.exists("/dst/file") || mem.exists("/dst/dir") {
+		t.Error("items moved between filesystems left behind")
+	}
+
+	if got := other.contents(t, "/mnt/dir/nested"); got != "nested" {
+		t.Errorf("got %q, want %q", got, "nested")
+	}
+
+	if got := other.contents(t, "/mnt/file"); got != "file" {
+		t.Errorf("got %q, want %q", got, "file")
+	}
+}
+
+func TestDeleteItems(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{
+		"/dir/file":       "file",
+		"/dir/sub/nested": "nested",
+		"/dir/kept":       "kept",
+	})
+
+	if err := deleteItems(filesystems, map[string]bool{"/dir/file": false, "/dir/sub": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/dir/file", "/dir/sub", "/dir/sub/nested"} {
+		if mem.exists(path) {
+			t.Errorf("%s not deleted", path)
+		}
+	}
+
+	if !mem.exists("/dir/kept") {
+		t.Error("unmarked item deleted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{
+		"/dir/old/file": "file",
+		"/elsewhere/":   "",
+	})
+
+	if err := filesystems.For("/dir/old").Rename("/dir/old", "/elsewhere/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem.exists("/dir/old") {
+		t.Error("renamed item left behind")
+	}
+
+	if got := mem.contents(t, "/elsewhere/new/file"); got != "file" {
+		t.Errorf("got %q, want %q", got, "file")
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{"/dir/existing": "existing"})
+
+	for _, path := range []string{"/dir/new", "/dir/missing/parents/new", "/dir/existing"} {
+		if err := createFile(filesystems.For(path), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !mem.exists("/dir/new") || !mem.exists("/dir/missing/parents/new") {
+		t.Error("files not created")
+	}
+
+	if got := mem.contents(t, "/dir/existing"); got != "existing" {
+		t.Errorf("existing file overwritten with %q", got)
+	}
+}
+
+func TestCreateFileTemplate(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+
+	templates := filepath.Join(config, "fm", "templates")
+	if err := os.MkdirAll(templates, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(templates, "sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	filesystems, mem := newMemFilesystems()
+	if err := createFile(filesystems.For("/script.sh"), "/script.sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mem.contents(t, "/script.sh"); got != "#!/bin/sh\n" {
+		t.Errorf("got %q, want the template", got)
+	}
+
+	if info, err := mem.Stat("/script.sh"); err != nil || info.Mode().Perm()&0111 == 0 {
+		t.Errorf("executable template produced %v, %v", info.Mode(), err)
+	}
+}
+
+// Links to directories containing them used to be followed forever
+func TestCopyItemsLinks(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	for _, dir := range []string{src, dst} {
+		if err := os.Mkdir(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{"up": "..", "root": "/", "file": "missing"}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := copyItems(newFilesystems(), map[string]bool{src: true}, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dst, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != len(links) {
+		t.Errorf("got %d items, want %d", len(entries), len(links))
+	}
+
+	for name, want := range links {
+		if got, err := os.Readlink(filepath.Join(dst, "src", name)); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+// Failing to list the directory again used to exit fm
+func TestRefreshFailure(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{"/dir/file": "file"})
+
+	fm := &Fm{Session: &Session{filesystems: filesystems}, path: "/dir"}
+	fm.Refresh()
+	if fm.message != nil || len(fm.items) != 1 {
+		t.Fatalf("got %v, %v", fm.items, fm.message)
+	}
+
+	mem.Remove("/dir")
+	fm.Refresh()
+	if !errors.Is(fm.message, fs.ErrNotExist) || len(fm.items) != 1 {
+		t.Errorf("got %v, %v after the directory was removed", fm.items, fm.message)
+	}
+}
+
+func TestPathSize(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	mem.populate(t, map[string]string{
+		"/dir/file":       "1234",
+		"/dir/sub/nested": "123456",
+		"/dir/empty/":     "",
+	})
+	if err := mem.Symlink("/dir", "/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link counts as itself, which is nothing in memory
+	if size, err := pathSize(context.Background(), filesystems, "/dir"); err != nil || size != 10 {
+		t.Errorf("got %d, %v, want 10", size, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pathSize(ctx, filesystems, "/dir"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
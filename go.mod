@@ -2,4 +2,15 @@ module github.com/shoumodip/fm
 
 go 1.21.6
 
-require github.com/vit1251/go-ncursesw v0.0.0-20211216195139-e61a3c4242a5
+require (
+	github.com/pkg/sftp v1.13.6
+	github.com/rivo/uniseg v0.4.7
+	github.com/ulikunitz/xz v0.5.12
+	github.com/vit1251/go-ncursesw v0.0.0-20211216195139-e61a3c4242a5
+	golang.org/x/crypto v0.31.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
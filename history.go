@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+const PROMPT_HISTORY_LIMIT = 100
+
+// Kinds of prompts with their own history
+const (
+	HISTORY_OPEN   = "open"
+	HISTORY_SEARCH = "search"
+	HISTORY_CREATE = "create"
+	HISTORY_RENAME = "rename"
+	HISTORY_FILTER = "filter"
+)
+
+func promptHistoryPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "history.json"), nil
+}
+
+func loadPromptHistory() (map[string][]string, error) {
+	history := make(map[string][]string)
+
+	path, err := promptHistoryPath()
+	if err != nil {
+		return history, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	} else if err != nil {
+		return history, err
+	}
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return make(map[string][]string), errors.New("could not parse '" + path + "': " + err.Error())
+	}
+
+	return history, nil
+}
+
+// Moves the entry to the end of the history if it already exists
+func (fm *Fm) AddPromptHistory(kind string, entry string) error {
+	history := fm.promptHistory[kind]
+	if index := slices.Index(history, entry); index != -1 {
+		history = slices.Delete(history, index, index+1)
+	}
+
+	history = append(history, entry)
+	if len(history) > PROMPT_HISTORY_LIMIT {
+		history = history[len(history)-PROMPT_HISTORY_LIMIT:]
+	}
+	fm.promptHistory[kind] = history
+
+	path, err := promptHistoryPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(fm.promptHistory)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Navigates the history of a prompt, only considering the entries starting
+// with whatever was typed before the navigation began
+type HistoryCursor struct {
+	entries []string
+	index   int
+	prefix  string
+}
+
+func NewHistoryCursor(entries []string) HistoryCursor {
+	return HistoryCursor{
+		entries: entries,
+		index:   len(entries),
+	}
+}
+
+func (h *HistoryCursor) Prev(input *Line) {
+	if h.index == len(h.entries) {
+		h.prefix = input.String()
+	}
+
+	for i := h.index - 1; i >= 0; i-- {
+		if strings.HasPrefix(h.entries[i], h.prefix) {
+			h.index = i
+			input.Set(h.entries[i])
+			return
+		}
+	}
+}
+
+func (h *HistoryCursor) Next(input *Line) {
+	if h.index == len(h.entries) {
+		return
+	}
+
+	h.index++
+	for h.index < len(h.entries) && !strings.HasPrefix(h.entries[h.index], h.prefix) {
+		h.index++
+	}
+
+	if h.index == len(h.entries) {
+		input.Set(h.prefix)
+	} else {
+		input.Set(h.entries[h.index])
+	}
+}
+
+// Reverse incremental search through the history, like C-r in readline. Keys
+// which are not part of the search accept the match, and are handed back to
+// the prompt.
+func (fm *Fm) ReverseSearchHistory(entries []string, input *Line) {
+	original := input.String()
+	query := []rune{}
+	found := -1
+
+	search := func(from int) int {
+		for i := min(from, len(entries)-1); i >= 0; i-- {
+			if strings.Contains(entries[i], string(query)) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for {
+		height, width := fm.window.MaxYX()
+
+		label := "(reverse-i-search)`" + string(query) + "': "
+		if found == -1 && len(query) > 0 {
+			label = "(failed " + label[1:]
+		}
+
+		fm.StyleOn(COLOR_PROMPT)
+		fm.window.MovePrint(height-1, 0, truncateWidth(label, width-1))
+		fm.StyleOff(COLOR_PROMPT)
+		fm.window.ClearToEOL()
+
+		if found != -1 {
+			fm.window.Print(truncateWidth(entries[found], width-1-len(label)))
+		}
+		fm.window.Refresh()
+
+		ch := fm.window.GetChar()
+		switch ch {
+		case 'r' & 0x1f:
+			if found > 0 {
+				if index := search(found - 1); index != -1 {
+					found = index
+				}
+			} else if found == -1 {
+				found = search(len(entries) - 1)
+			}
+
+		case gc.KEY_BACKSPACE:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				found = search(len(entries) - 1)
+			}
+
+		case 'g' & 0x1f, 'c' & 0x1f:
+			input.Set(original)
+			return
+
+		case gc.KEY_RESIZE:
+			fm.Layout()
+			fm.Render()
+
+		default:
+			if r := fm.DecodeInput(ch); r != utf8.RuneError && strconv.IsPrint(r) {
+				query = append(query, r)
+				if found == -1 {
+					found = search(len(entries) - 1)
+				} else {
+					found = search(found)
+				}
+				continue
+			}
+
+			if found != -1 {
+				input.Set(entries[found])
+			}
+
+			if ch != 27 {
+				gc.UnGetChar(gc.Char(ch))
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// Width of the icon column in cells, not counting the separating space
+const ICON_WIDTH = 2
+
+// Keys starting with ':' are types, keys starting with '*' are extensions and
+// everything else is an exact file name. Requires a Nerd Font.
+var defaultIcons = map[string]string{
+	":dir":  "",
+	":link": "",
+	":exec": "",
+	":file": "",
+
+	"Makefile":   "",
+	"Dockerfile": "",
+	"LICENSE":    "",
+	"go.mod":     "",
+	"go.sum":     "",
+	".git":       "",
+	".gitignore": "",
+
+	"*.go":   "",
+	"*.c":    "",
+	"*.h":    "",
+	"*.cpp":  "",
+	"*.hpp":  "",
+	"*.rs":   "",
+	"*.py":   "",
+	"*.js":   "",
+	"*.ts":   "",
+	"*.lua":  "",
+	"*.vim":  "",
+	"*.sh":   "",
+	"*.html": "",
+	"*.css":  "",
+	"*.json": "",
+	"*.md":   "",
+	"*.txt":  "",
+	"*.pdf":  "",
+	"*.png":  "",
+	"*.jpg":  "",
+	"*.jpeg": "",
+	"*.gif":  "",
+	"*.svg":  "",
+	"*.mp3":  "",
+	"*.flac": "",
+	"*.mp4":  "",
+	"*.mkv":  "",
+	"*.zip":  "",
+	"*.tar":  "",
+	"*.gz":   "",
+	"*.xz":   "",
+}
+
+// Icons are disabled unless 'icons = true' is set in the [general] section.
+// The [icons] section extends and overrides the default mapping.
+func parseIcons(config Config) (map[string]string, error) {
+	enabled := false
+	if value, ok := config["general"]["icons"]; ok {
+		var err error
+		enabled, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	icons := make(map[string]string)
+	for key, icon := range defaultIcons {
+		icons[key] = icon
+	}
+
+	for key, icon := range config["icons"] {
+		icons[key] = icon
+	}
+
+	return icons, nil
+}
+
+func itemIcon(icons map[string]string, item Item) string {
+	if icon, ok := icons[item.name]; ok {
+		return icon
+	}
+
+	if item.isDir {
+		return icons[":dir"]
+	}
+
+	if item.isLink {
+		return icons[":link"]
+	}
+
+	for ext := item.name; ; {
+		index := strings.IndexByte(ext[1:], '.')
+		if index == -1 {
+			break
+		}
+
+		// Try the longest extension first, so "*.tar.gz" wins over "*.gz"
+		ext = ext[index+1:]
+		if icon, ok := icons["*"+ext]; ok {
+			return icon
+		}
+	}
+
+	if item.mode&0111 != 0 {
+		return icons[":exec"]
+	}
+
+	return icons[":file"]
+}
+
+// Pads the icon to ICON_WIDTH cells, so that icons of different widths don't
+// misalign the names following them
+func (fm *Fm) PrintIcon(item Item) {
+	icon := itemIcon(fm.icons, item)
+
+	width := uniseg.StringWidth(icon)
+	if width > ICON_WIDTH {
+		icon = ""
+		width = 0
+	}
+
+	fm.window.Print(icon + strings.Repeat(" ", ICON_WIDTH-width+1))
+}
@@ -2,74 +2,182 @@ package main
 
 import (
 	"slices"
+	"strings"
 	"unicode"
+
+	"github.com/rivo/uniseg"
+)
+
+const KILL_RING_SIZE = 32
+
+// Killed text, shared between all the lines of a session
+type KillRing struct {
+	entries []string
+	index   int
+}
+
+func (r *KillRing) Push(text string) {
+	r.entries = append(r.entries, text)
+	if len(r.entries) > KILL_RING_SIZE {
+		r.entries = r.entries[1:]
+	}
+	r.index = len(r.entries) - 1
+}
+
+func (r *KillRing) Current() string {
+	return r.entries[r.index]
+}
+
+func (r *KillRing) Rotate() {
+	r.index = (r.index - 1 + len(r.entries)) % len(r.entries)
+}
+
+// Consecutive kills are accumulated into a single entry of the kill ring,
+// consecutive insertions into a single undo step, and M-y only makes sense
+// right after a yank
+const (
+	LINE_ACTION_NONE = iota
+	LINE_ACTION_INSERT
+	LINE_ACTION_KILL
+	LINE_ACTION_YANK
 )
 
+const LINE_UNDO_LIMIT = 100
+
+type lineState struct {
+	buffer []rune
+	cursor int
+}
+
+// The cursor is an index into the runes of the buffer, but it only ever rests
+// on grapheme cluster boundaries
 type Line struct {
-	buffer []byte
+	buffer []rune
 	cursor int
+	scroll int // The first visible display column
+
+	ring      *KillRing
+	last      int
+	yankStart int
+
+	undo []lineState
 }
 
 func NewLine(s string) Line {
+	buffer := []rune(s)
 	return Line{
-		buffer: []byte(s),
-		cursor: len(s),
+		buffer: buffer,
+		cursor: len(buffer),
 	}
 }
 
-func (l *Line) Insert(ch byte) {
+// Records the current text for undo, with the cursor at the given position
+func (l *Line) save(cursor int) {
+	l.undo = append(l.undo, lineState{slices.Clone(l.buffer), cursor})
+	if len(l.undo) > LINE_UNDO_LIMIT {
+		l.undo = l.undo[1:]
+	}
+}
+
+func (l *Line) Undo() {
+	if len(l.undo) == 0 {
+		return
+	}
+
+	state := l.undo[len(l.undo)-1]
+	l.undo = l.undo[:len(l.undo)-1]
+
+	l.buffer = state.buffer
+	l.cursor = state.cursor
+	l.last = LINE_ACTION_NONE
+}
+
+// Replaces the whole text, with the cursor at the end
+func (l *Line) Set(s string) {
+	l.save(l.cursor)
+	l.buffer = []rune(s)
+	l.cursor = len(l.buffer)
+	l.last = LINE_ACTION_NONE
+}
+
+func (l *Line) Insert(ch rune) {
+	if l.last != LINE_ACTION_INSERT {
+		l.save(l.cursor)
+	}
+
 	l.buffer = slices.Insert(l.buffer, l.cursor, ch)
 	l.cursor++
+	l.last = LINE_ACTION_INSERT
 }
 
 func (l *Line) Start() {
 	l.cursor = 0
+	l.last = LINE_ACTION_NONE
 }
 
 func (l *Line) End() {
 	l.cursor = len(l.buffer)
+	l.last = LINE_ACTION_NONE
 }
 
-func (l *Line) PrevChar() {
-	if l.cursor > 0 {
-		l.cursor--
+// The start of the grapheme cluster before the given position
+func (l *Line) prevBoundary(pos int) int {
+	state := -1
+	rest := string(l.buffer[:pos])
+	last := ""
+	for len(rest) > 0 {
+		last, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
 	}
+
+	return pos - len([]rune(last))
+}
+
+// The end of the grapheme cluster after the given position
+func (l *Line) nextBoundary(pos int) int {
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(string(l.buffer[pos:]), -1)
+	return pos + len([]rune(cluster))
+}
+
+func (l *Line) PrevChar() {
+	l.cursor = l.prevBoundary(l.cursor)
+	l.last = LINE_ACTION_NONE
 }
 
 func (l *Line) NextChar() {
-	if l.cursor < len(l.buffer) {
-		l.cursor++
-	}
+	l.cursor = l.nextBoundary(l.cursor)
+	l.last = LINE_ACTION_NONE
 }
 
 func isWord(ch rune) bool {
-	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_'
+	return unicode.IsLetter(ch) || unicode.IsMark(ch) || unicode.IsDigit(ch) || ch == '_'
 }
 
 func (l *Line) PrevWord() {
+	l.last = LINE_ACTION_NONE
 	if l.cursor == 0 {
 		return
 	}
 
-	for l.cursor > 0 && !isWord(rune(l.buffer[l.cursor-1])) {
+	for l.cursor > 0 && !isWord(l.buffer[l.cursor-1]) {
 		l.cursor--
 	}
 
-	for l.cursor > 0 && isWord(rune(l.buffer[l.cursor-1])) {
+	for l.cursor > 0 && isWord(l.buffer[l.cursor-1]) {
 		l.cursor--
 	}
 }
 
 func (l *Line) NextWord() {
+	l.last = LINE_ACTION_NONE
 	if l.cursor >= len(l.buffer) {
 		return
 	}
 
-	for l.cursor < len(l.buffer) && !isWord(rune(l.buffer[l.cursor])) {
+	for l.cursor < len(l.buffer) && !isWord(l.buffer[l.cursor]) {
 		l.cursor++
 	}
 
-	for l.cursor < len(l.buffer) && isWord(rune(l.buffer[l.cursor])) {
+	for l.cursor < len(l.buffer) && isWord(l.buffer[l.cursor]) {
 		l.cursor++
 	}
 }
@@ -83,10 +191,210 @@ func (l *Line) Delete(motion func(*Line)) {
 		start, end = end, start
 	}
 
+	if start != end {
+		l.save(mark)
+	}
+
 	l.buffer = slices.Delete(l.buffer, start, end)
 	l.cursor = start
 }
 
+// Same as Delete(), but the deleted text goes to the kill ring
+func (l *Line) Kill(motion func(*Line)) {
+	appending := l.last == LINE_ACTION_KILL
+
+	mark := l.cursor
+	motion(l)
+
+	start, end := min(mark, l.cursor), max(mark, l.cursor)
+	killed := string(l.buffer[start:end])
+	if start != end {
+		l.save(mark)
+	}
+
+	if l.ring != nil && killed != "" {
+		if appending && len(l.ring.entries) > 0 {
+			current := &l.ring.entries[len(l.ring.entries)-1]
+			if l.cursor < mark {
+				*current = killed + *current
+			} else {
+				*current += killed
+			}
+			l.ring.index = len(l.ring.entries) - 1
+		} else {
+			l.ring.Push(killed)
+		}
+	}
+
+	l.buffer = slices.Delete(l.buffer, start, end)
+	l.cursor = start
+	l.last = LINE_ACTION_KILL
+}
+
+func (l *Line) Yank() {
+	if l.ring == nil || len(l.ring.entries) == 0 {
+		return
+	}
+
+	l.ring.index = len(l.ring.entries) - 1
+	text := []rune(l.ring.Current())
+
+	l.save(l.cursor)
+	l.yankStart = l.cursor
+	l.buffer = slices.Insert(l.buffer, l.cursor, text...)
+	l.cursor += len(text)
+	l.last = LINE_ACTION_YANK
+}
+
+// Replaces the text just yanked with the previous entry in the kill ring
+func (l *Line) YankPop() {
+	if l.last != LINE_ACTION_YANK || len(l.ring.entries) < 2 {
+		return
+	}
+
+	l.ring.Rotate()
+	text := []rune(l.ring.Current())
+
+	l.save(l.cursor)
+	l.buffer = slices.Replace(l.buffer, l.yankStart, l.cursor, text...)
+	l.cursor = l.yankStart + len(text)
+	l.last = LINE_ACTION_YANK
+}
+
+// Swaps the characters around the cursor and moves past them. At the end of
+// the line, swaps the last two characters instead.
+func (l *Line) Transpose() {
+	l.last = LINE_ACTION_NONE
+
+	pos := l.cursor
+	if pos == len(l.buffer) {
+		pos = l.prevBoundary(pos)
+	}
+
+	if pos == 0 {
+		return
+	}
+
+	start := l.prevBoundary(pos)
+	end := l.nextBoundary(pos)
+
+	l.save(l.cursor)
+	swapped := append(slices.Clone(l.buffer[pos:end]), l.buffer[start:pos]...)
+	copy(l.buffer[start:end], swapped)
+	l.cursor = end
+}
+
+// Applies the transform to the text from the cursor to the end of the next
+// word, and moves past it
+func (l *Line) changeCase(transform func(string) string) {
+	start := l.cursor
+	l.NextWord()
+	l.save(start)
+
+	changed := []rune(transform(string(l.buffer[start:l.cursor])))
+	l.buffer = slices.Replace(l.buffer, start, l.cursor, changed...)
+	l.cursor = start + len(changed)
+}
+
+func (l *Line) UpcaseWord() {
+	l.changeCase(strings.ToUpper)
+}
+
+func (l *Line) DowncaseWord() {
+	l.changeCase(strings.ToLower)
+}
+
+func (l *Line) CapitalizeWord() {
+	l.changeCase(func(text string) string {
+		runes := []rune(strings.ToLower(text))
+		for i, r := range runes {
+			if isWord(r) {
+				runes[i] = unicode.ToUpper(r)
+				break
+			}
+		}
+		return string(runes)
+	})
+}
+
+func (l *Line) ReplaceBeforeCursor(text string) {
+	l.save(l.cursor)
+	l.last = LINE_ACTION_NONE
+	l.buffer = append([]rune(text), l.buffer[l.cursor:]...)
+	l.cursor = len([]rune(text))
+}
+
+// The display column of the cursor, in terminal cells
+func (l Line) Column() int {
+	return uniseg.StringWidth(string(l.buffer[:l.cursor]))
+}
+
+// Returns the part of the line visible in the given number of cells with the
+// cursor in view, and the column of the cursor within it. Hidden text on either
+// side is indicated with '<' and '>'.
+func (l *Line) View(width int) (string, int) {
+	column := l.Column()
+	total := uniseg.StringWidth(l.String())
+	if total < width {
+		l.scroll = 0
+		return l.String(), column
+	}
+
+	// The right edge is always reserved, as either text or the cursor lie there.
+	// The left edge is reserved only once scrolled, which can in turn push the
+	// cursor out of view, hence the second pass.
+	inner := width - 1
+	for i := 0; i < 2; i++ {
+		inner = width - 1
+		if l.scroll > 0 {
+			inner--
+		}
+
+		// Keep the view filled when the text gets shorter or the view wider
+		l.scroll = min(l.scroll, max(total-inner+1, 0))
+
+		if column < l.scroll {
+			l.scroll = column
+		}
+
+		if column >= l.scroll+inner {
+			l.scroll = column - inner + 1
+		}
+	}
+	l.scroll = max(l.scroll, 0)
+
+	view := ""
+	left := 0
+	if l.scroll > 0 {
+		view = "<"
+		left = 1
+	}
+
+	start := 0
+	state := -1
+	rest := l.String()
+	for len(rest) > 0 {
+		var cluster string
+		var cells int
+		cluster, rest, cells, state = uniseg.FirstGraphemeClusterInString(rest, state)
+
+		end := start + cells
+		if start >= l.scroll && end <= l.scroll+inner {
+			view += cluster
+		} else if end > l.scroll && start < l.scroll+inner {
+			// Wide characters cut in half by the edges
+			view += strings.Repeat(" ", min(end, l.scroll+inner)-max(start, l.scroll))
+		}
+		start = end
+	}
+
+	if total > l.scroll+inner {
+		view += ">"
+	}
+
+	return view, left + column - l.scroll
+}
+
 func (l Line) String() string {
 	return string(l.buffer)
 }
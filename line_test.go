@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rivo/uniseg"
+)
+
+func TestLineViewBackspace(t *testing.T) {
+	const width = 11
+
+	line := NewLine("")
+	for i := 0; i < 40; i++ {
+		line.Insert(rune('a' + i%26))
+	}
+
+	for len(line.buffer) > 0 {
+		line.Delete((*Line).PrevChar)
+
+		view, column := line.View(width)
+		text := strings.TrimLeft(view, "<")
+		if want := min(len(line.buffer), width-3); uniseg.StringWidth(text) < want {
+			t.Fatalf("with %d characters the view is %q, want at least %d of them", len(line.buffer), view, want)
+		}
+
+		if column != uniseg.StringWidth(view) {
+			t.Fatalf("with %d characters the cursor is at %d in %q, want it at the end", len(line.buffer), column, view)
+		}
+	}
+}
+
+func TestLineViewWider(t *testing.T) {
+	line := NewLine(strings.Repeat("x", 30))
+	line.End()
+	line.View(10)
+
+	if view, _ := line.View(25); view != "<"+strings.Repeat("x", 22) {
+		t.Errorf("got %q after widening the view", view)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+// Links can't point into other filesystems, like from the local disk to a
+// remote host or into an archive
+func linkItems(filesystems *Filesystems, items map[string]bool, dir string, link func(filesystem Filesystem, item, dst string) error) error {
+	for item := range items {
+		dst := filepath.Join(dir, filepath.Base(item))
+		if dst == item {
+			return errors.New("cannot link '" + filepath.Base(item) + "' onto itself")
+		}
+
+		if filesystems.For(item) != filesystems.For(dst) {
+			return errors.New("cannot link '" + filepath.Base(item) + "' across filesystems")
+		}
+
+		if err := link(filesystems.For(dst), item, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func symlinkAbsolute(filesystem Filesystem, item, dst string) error {
+	return filesystem.Symlink(item, dst)
+}
+
+func symlinkRelative(filesystem Filesystem, item, dst string) error {
+	target, err := filepath.Rel(filepath.Dir(dst), item)
+	if err != nil {
+		return err
+	}
+
+	return filesystem.Symlink(target, dst)
+}
+
+// Absolute targets of links on remote hosts are on the same host
+func linkTarget(item Item) string {
+	if !filepath.IsAbs(item.target) {
+		return filepath.Join(filepath.Dir(item.path), item.target)
+	}
+
+	if host, _, ok := splitRemotePath(item.path); ok {
+		return remotePath(host, item.target)
+	}
+	return filepath.Clean(item.target)
+}
+
+// Jumps to the directory containing the target of the link under the cursor,
+// with the cursor on the target
+func (fm *Fm) FollowLink() {
+	if len(fm.items) == 0 || !fm.items[fm.cursor].isLink {
+		fm.message = errors.New("not a symbolic link")
+		return
+	}
+
+	target := linkTarget(fm.items[fm.cursor])
+
+	if dir := filepath.Dir(target); dir != fm.path {
+		fm.GotoDir(dir)
+		if fm.path != dir {
+			return
+		}
+	}
+
+	fm.FindExact(filepath.Base(target))
+}
+
+func (fm *Fm) LinkCommand(ch gc.Key) {
+	var action string
+	var link func(filesystem Filesystem, item, dst string) error
+
+	switch ch {
+	case 'a':
+		action = "Symlink"
+		link = symlinkAbsolute
+
+	case 'r':
+		action = "Relative symlink"
+		link = symlinkRelative
+
+	case 'h':
+		action = "Hard link"
+		link = func(_ Filesystem, item, dst string) error {
+			if !fm.filesystems.IsLocal(item) || !fm.filesystems.IsLocal(dst) {
+				return errors.New("hard links can only be made on the local disk")
+			}
+			return os.Link(item, dst)
+		}
+
+	case 'f':
+		fm.FollowLink()
+		return
+
+	case 27:
+		return
+
+	default:
+		fm.message = errors.New("unknown link command '" + gc.KeyString(ch) + "'")
+		return
+	}
+
+	if len(fm.marked) == 0 {
+		fm.message = errors.New("no marked items to link")
+		return
+	}
+
+	if !fm.CheckWritable(fm.path) {
+		return
+	}
+
+	if fm.Confirm(fm.MarkedPromptAndPopup(action, fm.marked)) {
+		fm.message = linkItems(fm.filesystems, fm.marked, fm.path, link)
+		fm.Refresh()
+		fm.marked = make(map[string]bool)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestLinkTarget(t *testing.T) {
+	tests := []struct {
+		path   string
+		target string
+		want   string
+	}{
+		{"/home/user/link", "file", "/home/user/file"},
+		{"/home/user/link", "../other/file", "/home/other/file"},
+		{"/home/user/link", "/etc/foo", "/etc/foo"},
+		{remotePath("user@host", "/srv/link"), "file", remotePath("user@host", "/srv/file")},
+		{remotePath("user@host", "/srv/link"), "/etc/foo", remotePath("user@host", "/etc/foo")},
+	}
+
+	for _, test := range tests {
+		if got := linkTarget(Item{path: test.path, target: test.target}); got != test.want {
+			t.Errorf("link at %q to %q: got %q, want %q", test.path, test.target, got, test.want)
+		}
+	}
+}
+
+func TestLinkItemsAcrossFilesystems(t *testing.T) {
+	filesystems, mem := newMemFilesystems()
+	other := newMemFilesystem()
+	filesystems.Mount("/mnt", other)
+	mem.populate(t, map[string]string{"/src/file": "file", "/dst/": ""})
+	other.populate(t, map[string]string{"/mnt/": ""})
+
+	items := map[string]bool{"/src/file": false}
+	for _, link := range []func(Filesystem, string, string) error{symlinkAbsolute, symlinkRelative} {
+		if err := linkItems(filesystems, items, "/mnt", link); err == nil {
+			t.Error("linking across filesystems succeeded")
+		}
+	}
+
+	if err := linkItems(filesystems, items, "/dst", symlinkRelative); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := mem.Readlink("/dst/file"); err != nil || target != "../src/file" {
+		t.Errorf("got link to %q, %v, want %q", target, err, "../src/file")
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/rivo/uniseg"
 	gc "github.com/vit1251/go-ncursesw"
 )
 
@@ -37,7 +42,14 @@ func handleError(err error) {
 type Item struct {
 	name  string
 	path  string
-	isDir bool
+	isDir bool // Also true for symbolic links pointing to directories
+
+	isLink   bool
+	isBroken bool
+	target   string
+
+	mode       fs.FileMode // Of the item itself, not the target of a link
+	targetMode fs.FileMode // Of the target of a link that is not broken
 }
 
 func sortItems(items []Item) {
@@ -50,29 +62,77 @@ func sortItems(items []Item) {
 	})
 }
 
-func listDir(path string) ([]Item, error) {
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
+// Patterns prefixed with "re:" are regular expressions, patterns containing
+// any of "*?[" are globs, everything else is a plain substring. Matching is
+// always case insensitive, just like search.
+func compileFilter(pattern string) (func(string) bool, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, err
+		}
+
+		return re.MatchString, nil
 	}
 
-	items := make([]Item, len(entries))
-	for index, entry := range entries {
-		items[index] = Item{
-			name:  entry.Name(),
-			path:  filepath.Join(path, entry.Name()),
-			isDir: entry.IsDir(),
+	pattern = strings.ToLower(pattern)
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
 		}
+
+		return func(name string) bool {
+			matched, _ := filepath.Match(pattern, strings.ToLower(name))
+			return matched
+		}, nil
 	}
 
-	sortItems(items)
-	return items, nil
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), pattern)
+	}, nil
+}
+
+func filterItems(items []Item, match func(string) bool) []Item {
+	filtered := []Item{}
+	for _, item := range items {
+		if match(item.name) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
 }
 
+// State shared by all the panes
+type Session struct {
+	tty    *os.File
+	screen *gc.Window
+
+	panes  []*Fm // Two when the screen is split
+	active *Fm
+
+	registers     map[string]map[string]bool
+	promptHistory map[string][]string
+	killRing      KillRing
+	lsColors      LsColors
+	theme         Theme
+	icons         map[string]string // Nil when icons are disabled
+
+	clipboard    map[string]bool
+	clipboardCut bool
+
+	filesystems *Filesystems
+	tempDir     string // For opening items not on the local disk
+}
+
+// A pane showing a directory
 type Fm struct {
-	tty     *os.File
-	window  *gc.Window
-	message error
+	*Session
+
+	window     *gc.Window // The part of the screen taken up by the pane
+	ownsWindow bool       // Made for the pane by Layout(), rather than being the whole screen
+	message    error
+	notice     string
 
 	path     string
 	pathPrev string
@@ -86,9 +146,14 @@ type Fm struct {
 	height  int
 	marked  map[string]bool
 	history map[string]string
+	filters map[string]string
+
+	visual      bool
+	visualStart int
 
-	searchQuery   string
-	searchReverse bool
+	searchQuery     string
+	searchReverse   bool
+	searchHighlight bool
 
 	showedInitHelpMessage bool
 }
@@ -98,9 +163,19 @@ const (
 	COLOR_MARK
 	COLOR_ERROR
 	COLOR_TITLE
+	COLOR_MATCH
+	COLOR_LINK
+	COLOR_FILE
+	COLOR_BROKEN
+	COLOR_CURSOR
+	COLOR_PROMPT
+	COLOR_BORDER
+	COLOR_STATUS
+
+	COLOR_COUNT // Dynamically allocated color pairs start from here
 )
 
-func terminalInit() (*os.File, *gc.Window) {
+func terminalInit(theme *Theme) (*os.File, *gc.Window) {
 	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
 	handleError(err)
 
@@ -119,32 +194,82 @@ func terminalInit() (*os.File, *gc.Window) {
 	gc.StartColor()
 	gc.UseDefaultColors()
 
-	gc.InitPair(COLOR_DIR, gc.C_BLUE, -1)
-	gc.InitPair(COLOR_MARK, gc.C_MAGENTA, -1)
-	gc.InitPair(COLOR_ERROR, gc.C_RED, -1)
-	gc.InitPair(COLOR_TITLE, gc.C_CYAN, -1)
+	for element, style := range theme {
+		if element != 0 {
+			gc.InitPair(int16(element), fitColor(style.fg), fitColor(style.bg))
+		}
+	}
+	initDynamicPairs()
 
 	return tty, window
 }
 
-func fmInit(path string) Fm {
-	path, err := filepath.Abs(path)
+func fmInit(path string) *Fm {
+	config, err := loadConfig()
 	handleError(err)
 
-	items, err := listDir(path)
+	// Paths can be saved as bookmarks in the config, and opened with "@name"
+	if name, ok := strings.CutPrefix(path, "@"); ok {
+		bookmark, ok := config["bookmarks"][name]
+		if !ok {
+			handleError(errors.New("no bookmark named '" + name + "'"))
+		}
+		path = bookmark
+	}
+
+	filesystems := newFilesystems()
+
+	if strings.HasPrefix(path, SFTP_SCHEME) {
+		path, err = parseRemoteURL(filesystems, path)
+	} else {
+		path, err = filepath.Abs(path)
+	}
 	handleError(err)
 
-	tty, window := terminalInit()
-	fm := Fm{
-		tty:      tty,
-		window:   window,
+	items, err := filesystems.List(path)
+	handleError(err)
+
+	theme, err := parseTheme(config)
+	handleError(err)
+
+	icons, err := parseIcons(config)
+	handleError(err)
+
+	// Failing to load the saved state is not fatal, just reported
+	registers, loadErr := loadRegisters()
+	promptHistory, err := loadPromptHistory()
+	if loadErr == nil {
+		loadErr = err
+	}
+
+	tty, screen := terminalInit(&theme)
+	session := &Session{
+		tty:    tty,
+		screen: screen,
+
+		registers:     registers,
+		promptHistory: promptHistory,
+		lsColors:      parseLsColors(os.Getenv("LS_COLORS")),
+		theme:         theme,
+		icons:         icons,
+		filesystems:   filesystems,
+	}
+
+	fm := &Fm{
+		Session:  session,
+		window:   screen,
+		message:  loadErr,
 		path:     path,
 		items:    items,
 		marked:   make(map[string]bool),
 		history:  make(map[string]string),
+		filters:  make(map[string]string),
 		pathInit: path,
 	}
 
+	session.panes = []*Fm{fm}
+	session.active = fm
+
 	fm.Render()
 	return fm
 }
@@ -152,15 +277,19 @@ func fmInit(path string) Fm {
 func (fm *Fm) Render() {
 	fm.window.Erase()
 
-	fm.window.AttrOn(gc.A_BOLD)
-	fm.window.ColorOn(COLOR_TITLE)
-	fm.window.Print(fm.path)
-	fm.window.AttrOff(gc.A_BOLD)
-	fm.window.ColorOff(COLOR_TITLE)
-
-	fm.height, _ = fm.window.MaxYX()
+	var width int
+	fm.height, width = fm.window.MaxYX()
 	rows := fm.height - 2
 
+	title := truncateWidth(displayPath(fm.path), width)
+	fm.StyleOn(COLOR_TITLE)
+	fm.window.Print(title)
+	fm.StyleOff(COLOR_TITLE)
+
+	if filter, ok := fm.filters[fm.path]; ok {
+		fm.window.Print(truncateWidth(" [filter: "+filter+"]", width-uniseg.StringWidth(title)))
+	}
+
 	if fm.cursor >= fm.anchor+rows {
 		fm.anchor = fm.cursor - rows + 1
 	}
@@ -172,37 +301,82 @@ func (fm *Fm) Render() {
 	last := min(len(fm.items), rows+fm.anchor)
 
 	line := 1
+	visualStart, visualEnd := fm.VisualRange()
+
 	for i := fm.anchor; i < last; i++ {
-		if i == fm.cursor {
-			fm.window.AttrOn(gc.A_REVERSE)
+		// Only the active pane shows its cursor
+		selected := (i == fm.cursor && fm.active == fm) || (i >= visualStart && i <= visualEnd)
+		if selected {
+			fm.StyleOn(COLOR_CURSOR)
 		}
 
-		if fm.items[i].isDir {
-			fm.window.ColorOn(COLOR_DIR)
+		// A colored cursor line takes precedence over the color of the item
+		attr, color := fm.ItemStyle(fm.items[i])
+		if selected && fm.theme[COLOR_CURSOR].HasColor() {
+			color = COLOR_CURSOR
+		} else if color != 0 {
+			fm.window.ColorOn(color)
 		}
+		fm.window.AttrOn(attr)
+
+		// One cell is reserved for the mark
+		available := width - 1
+		if fm.icons != nil {
+			available -= ICON_WIDTH + 1
+		}
+
+		name := truncateWidth(fm.items[i].name, available)
+		available -= uniseg.StringWidth(name)
 
-		fm.window.MovePrint(line, 0, fm.items[i].name)
+		fm.window.Move(line, 0)
+		if fm.icons != nil {
+			fm.PrintIcon(fm.items[i])
+		}
+		fm.PrintHighlighted(name, color)
 		line++
 
-		if i == fm.cursor {
-			fm.window.AttrOff(gc.A_REVERSE)
+		fm.window.AttrOff(attr)
+		if selected {
+			fm.StyleOff(COLOR_CURSOR)
 		}
 
-		if fm.items[i].isDir {
-			fm.window.ColorOff(COLOR_DIR)
+		if color != 0 {
+			fm.window.ColorOff(color)
 		}
 
 		if _, ok := fm.marked[fm.items[i].path]; ok {
-			fm.window.AttrOn(gc.A_BOLD)
-			fm.window.ColorOn(COLOR_MARK)
+			fm.StyleOn(COLOR_MARK)
 			fm.window.Print("*")
-			fm.window.AttrOff(gc.A_BOLD)
-			fm.window.ColorOff(COLOR_MARK)
+			fm.StyleOff(COLOR_MARK)
+		}
+
+		if fm.items[i].isLink {
+			fm.window.Print(truncateWidth(" -> "+fm.items[i].target, available))
 		}
 	}
 
+	fm.StyleOn(COLOR_STATUS)
+
+	if status := fm.ClipboardStatus(); status != "" {
+		fm.window.MovePrint(fm.height-1, max(width-len(status)-1, 0), status)
+	}
+
 	if fm.count != 0 {
 		fm.window.MovePrintf(fm.height-1, 0, "%d-", fm.count)
+	} else if fm.visual {
+		fm.window.MovePrintf(fm.height-1, 0, "-- VISUAL -- %d item(s)", visualEnd-visualStart+1)
+	} else if fm.searchHighlight {
+		prefix := "/"
+		if fm.searchReverse {
+			prefix = "?"
+		}
+
+		index, total := fm.MatchPosition()
+		if index != -1 {
+			fm.window.MovePrintf(fm.height-1, 0, "%s%s  match %d of %d", prefix, fm.searchQuery, index+1, total)
+		} else {
+			fm.window.MovePrintf(fm.height-1, 0, "%s%s  %d match(es)", prefix, fm.searchQuery, total)
+		}
 	}
 
 	if !fm.showedInitHelpMessage {
@@ -210,19 +384,118 @@ func (fm *Fm) Render() {
 		fm.showedInitHelpMessage = true
 	}
 
+	if fm.message == nil && fm.notice != "" {
+		fm.window.MovePrint(fm.height-1, 0, fm.notice)
+	}
+
+	fm.StyleOff(COLOR_STATUS)
+
 	if fm.message != nil {
-		fm.window.AttrOn(gc.A_BOLD)
-		fm.window.ColorOn(COLOR_ERROR)
+		fm.StyleOn(COLOR_ERROR)
 		fm.window.MovePrint(fm.height-1, 0, fm.message)
-		fm.window.AttrOff(gc.A_BOLD)
-		fm.window.ColorOff(COLOR_ERROR)
+		fm.StyleOff(COLOR_ERROR)
 
 		fm.message = nil
 	}
 
+	fm.notice = ""
 	fm.window.Refresh()
 }
 
+func itemColor(item Item) int16 {
+	switch {
+	case item.isBroken:
+		return COLOR_BROKEN
+	case item.isLink:
+		return COLOR_LINK
+	case item.isDir:
+		return COLOR_DIR
+	default:
+		return COLOR_FILE
+	}
+}
+
+// Cuts the text down to the given number of terminal cells, indicating the
+// truncation with an ellipsis
+func truncateWidth(text string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+
+	if uniseg.StringWidth(text) <= width {
+		return text
+	}
+
+	result := ""
+	used := 0
+	state := -1
+	for len(text) > 0 {
+		var cluster string
+		var cells int
+		cluster, text, cells, state = uniseg.FirstGraphemeClusterInString(text, state)
+		if used+cells > width-1 {
+			break
+		}
+
+		result += cluster
+		used += cells
+	}
+
+	return result + "…"
+}
+
+func findMatches(text string, pred string) [][2]int {
+	if pred == "" {
+		return nil
+	}
+
+	// Lowercasing may change the byte length of some runes, in which case the
+	// offsets would no longer line up with the original text
+	lower := strings.ToLower(text)
+	pred = strings.ToLower(pred)
+	if len(lower) != len(text) {
+		return nil
+	}
+
+	matches := [][2]int{}
+	for start := 0; start < len(lower); {
+		index := strings.Index(lower[start:], pred)
+		if index == -1 {
+			break
+		}
+
+		start += index
+		matches = append(matches, [2]int{start, start + len(pred)})
+		start += len(pred)
+	}
+
+	return matches
+}
+
+func (fm *Fm) PrintHighlighted(text string, color int16) {
+	if !fm.searchHighlight {
+		fm.window.Print(text)
+		return
+	}
+
+	last := 0
+	for _, match := range findMatches(text, fm.searchQuery) {
+		fm.window.Print(text[last:match[0]])
+
+		fm.StyleOn(COLOR_MATCH)
+		fm.window.Print(text[match[0]:match[1]])
+		fm.StyleOff(COLOR_MATCH)
+
+		if color != 0 {
+			fm.window.ColorOn(color)
+		}
+
+		last = match[1]
+	}
+
+	fm.window.Print(text[last:])
+}
+
 func (fm *Fm) Popup(lines []string, cursor *int) gc.Key {
 	cursorBackup := 0
 	if cursor == nil {
@@ -237,7 +510,9 @@ func (fm *Fm) Popup(lines []string, cursor *int) gc.Key {
 		y := (fm.height - 1) / 2
 		rows := fm.height - y - 2
 
+		fm.StyleOn(COLOR_BORDER)
 		fm.window.HLine(y, 0, gc.ACS_HLINE, width)
+		fm.StyleOff(COLOR_BORDER)
 
 		for i := 0; i < rows; i++ {
 			fm.window.Move(y+i+1, 0)
@@ -300,11 +575,9 @@ func (fm *Fm) Confirm(query string, popupLines []string) bool {
 	for {
 		height, _ := fm.window.MaxYX()
 
-		fm.window.AttrOn(gc.A_BOLD)
-		fm.window.ColorOn(COLOR_DIR)
+		fm.StyleOn(COLOR_PROMPT)
 		fm.window.MovePrint(height-1, 0, query)
-		fm.window.AttrOff(gc.A_BOLD)
-		fm.window.ColorOff(COLOR_DIR)
+		fm.StyleOff(COLOR_PROMPT)
 		fm.window.ClearToEOL()
 		fm.window.Refresh()
 
@@ -315,7 +588,10 @@ func (fm *Fm) Confirm(query string, popupLines []string) bool {
 			ch = fm.Popup(popupLines, &popupCursor)
 		}
 
-		if ch == 27 || ch == 'n' || ch == 'N' {
+		if ch == gc.KEY_RESIZE {
+			fm.Layout()
+			fm.Render()
+		} else if ch == 27 || ch == 'n' || ch == 'N' {
 			return false
 		} else if ch == 'y' || ch == 'Y' {
 			return true
@@ -323,40 +599,92 @@ func (fm *Fm) Confirm(query string, popupLines []string) bool {
 	}
 }
 
-func (fm *Fm) Prompt(query string, init string, update func(string) bool) (string, bool) {
+// Curses hands out UTF-8 encoded input one byte at a time. Special keys are
+// not characters, and are decoded as utf8.RuneError.
+func (fm *Fm) DecodeInput(ch gc.Key) rune {
+	if ch > 0xff {
+		return utf8.RuneError
+	}
+
+	if ch < 0x80 {
+		return rune(ch)
+	}
+
+	buffer := []byte{byte(ch)}
+	for !utf8.FullRune(buffer) {
+		next := fm.window.GetChar()
+		if next < 0x80 || next > 0xbf {
+			return utf8.RuneError
+		}
+
+		buffer = append(buffer, byte(next))
+	}
+
+	r, _ := utf8.DecodeRune(buffer)
+	return r
+}
+
+// The history is the kind of the prompt, or "" for none
+func (fm *Fm) Prompt(query string, init string, update func(string) bool, complete Completer, history string) (string, bool) {
 	gc.Cursor(1)
 	defer gc.Cursor(0)
 
 	input := NewLine(init)
+	input.ring = &fm.killRing
 	error := false
+	completion := Completion{complete: complete}
+	historyCursor := NewHistoryCursor(fm.promptHistory[history])
 
 	for {
-		height, _ := fm.window.MaxYX()
+		height, width := fm.window.MaxYX()
+
+		if completion.Active() {
+			fm.DrawCompletion(&completion)
+		}
 
-		fm.window.AttrOn(gc.A_BOLD)
-		fm.window.ColorOn(COLOR_DIR)
+		fm.StyleOn(COLOR_PROMPT)
 		fm.window.MovePrint(height-1, 0, query)
-		fm.window.AttrOff(gc.A_BOLD)
-		fm.window.ColorOff(COLOR_DIR)
+		fm.StyleOff(COLOR_PROMPT)
 		fm.window.ClearToEOL()
 
 		if error {
-			fm.window.AttrOn(gc.A_BOLD)
-			fm.window.ColorOn(COLOR_ERROR)
+			fm.StyleOn(COLOR_ERROR)
 		}
 
-		fm.window.Print(input.String())
+		// The last cell of the screen is left alone, as writing to it scrolls
+		// the terminal on some implementations
+		queryWidth := uniseg.StringWidth(query)
+		view, column := input.View(max(width-queryWidth-1, 2))
+		fm.window.Print(view)
 
 		if error {
-			fm.window.AttrOff(gc.A_BOLD)
-			fm.window.ColorOff(COLOR_ERROR)
+			fm.StyleOff(COLOR_ERROR)
 		}
 
-		fm.window.Move(height-1, len(query)+input.cursor)
+		fm.window.Move(height-1, queryWidth+column)
 		fm.window.Refresh()
 
 		ch := fm.window.GetChar()
+
+		if completion.Active() && ch != gc.KEY_TAB && ch != gc.KEY_BTAB {
+			completion.Reset()
+			fm.Render()
+		}
+
 		switch ch {
+		case gc.KEY_RESIZE:
+			fm.Layout()
+			fm.Render()
+
+		case gc.KEY_TAB, gc.KEY_BTAB:
+			if complete != nil {
+				if ch == gc.KEY_TAB {
+					completion.Next(&input, 1)
+				} else {
+					completion.Next(&input, -1)
+				}
+			}
+
 		case 27:
 			fm.window.Timeout(10)
 			ch := fm.window.GetChar()
@@ -373,10 +701,22 @@ func (fm *Fm) Prompt(query string, init string, update func(string) bool) (strin
 				input.PrevWord()
 
 			case 'd':
-				input.Delete((*Line).NextWord)
+				input.Kill((*Line).NextWord)
 
 			case gc.KEY_BACKSPACE:
-				input.Delete((*Line).PrevWord)
+				input.Kill((*Line).PrevWord)
+
+			case 'y':
+				input.YankPop()
+
+			case 'u':
+				input.UpcaseWord()
+
+			case 'l':
+				input.DowncaseWord()
+
+			case 'c':
+				input.CapitalizeWord()
 			}
 
 		case 'c' & 0x1f:
@@ -398,20 +738,44 @@ func (fm *Fm) Prompt(query string, init string, update func(string) bool) (strin
 			input.Delete((*Line).NextChar)
 
 		case 'k' & 0x1f:
-			input.Delete((*Line).End)
+			input.Kill((*Line).End)
 
 		case 'u' & 0x1f:
-			input.Delete((*Line).Start)
+			input.Kill((*Line).Start)
+
+		case 'y' & 0x1f:
+			input.Yank()
+
+		case 't' & 0x1f:
+			input.Transpose()
+
+		// Terminals send C-_ for C-/ as well
+		case '_' & 0x1f:
+			input.Undo()
+
+		case gc.KEY_UP, 'p' & 0x1f:
+			historyCursor.Prev(&input)
+
+		case gc.KEY_DOWN, 'n' & 0x1f:
+			historyCursor.Next(&input)
+
+		case 'r' & 0x1f:
+			if history != "" {
+				fm.ReverseSearchHistory(fm.promptHistory[history], &input)
+			}
 
 		case gc.KEY_RETURN:
+			if history != "" && input.String() != "" {
+				fm.message = fm.AddPromptHistory(history, input.String())
+			}
 			return input.String(), true
 
 		case gc.KEY_BACKSPACE:
 			input.Delete((*Line).PrevChar)
 
 		default:
-			if strconv.IsPrint(rune(ch)) {
-				input.Insert(byte(ch))
+			if r := fm.DecodeInput(ch); r != utf8.RuneError && strconv.IsPrint(r) {
+				input.Insert(r)
 			}
 		}
 
@@ -487,6 +851,89 @@ func (fm *Fm) FindQueryReverse(pred string, from int) bool {
 	return false
 }
 
+func (fm *Fm) MatchPosition() (int, int) {
+	index := -1
+	total := 0
+
+	pred := strings.ToLower(fm.searchQuery)
+	for i, item := range fm.items {
+		if strings.Contains(strings.ToLower(item.name), pred) {
+			if i == fm.cursor {
+				index = total
+			}
+			total++
+		}
+	}
+
+	return index, total
+}
+
+func (fm *Fm) ListDir(path string) ([]Item, error) {
+	items, err := fm.filesystems.List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter, ok := fm.filters[path]; ok {
+		match, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		items = filterItems(items, match)
+	}
+
+	return items, nil
+}
+
+func (fm *Fm) Filter() {
+	items, err := fm.filesystems.List(fm.path)
+	if err != nil {
+		fm.message = err
+		return
+	}
+
+	name := ""
+	if fm.cursor < len(fm.items) {
+		name = fm.items[fm.cursor].name
+	}
+
+	apply := func(pattern string) bool {
+		match, err := compileFilter(pattern)
+		if err != nil {
+			return false
+		}
+
+		if pattern == "" {
+			fm.items = items
+		} else {
+			fm.items = filterItems(items, match)
+		}
+
+		fm.cursor = 0
+		fm.FindExact(name)
+		return true
+	}
+
+	prevFilter := fm.filters[fm.path]
+	pattern, ok := fm.Prompt("Filter: ", prevFilter, apply, nil, HISTORY_FILTER)
+	if !ok {
+		pattern = prevFilter
+	}
+
+	if !apply(pattern) {
+		fm.message = errors.New("invalid filter '" + pattern + "'")
+		pattern = prevFilter
+		apply(pattern)
+	}
+
+	if pattern == "" {
+		delete(fm.filters, fm.path)
+	} else {
+		fm.filters[fm.path] = pattern
+	}
+}
+
 func (fm *Fm) HistorySave() {
 	if fm.cursor < len(fm.items) {
 		fm.history[fm.path] = fm.items[fm.cursor].name
@@ -508,7 +955,7 @@ func (fm *Fm) BeginSwitchDir(path string, items []Item) {
 }
 
 func (fm *Fm) GotoDir(dir string) {
-	items, err := listDir(dir)
+	items, err := fm.ListDir(dir)
 	if err != nil {
 		fm.message = err
 		return
@@ -538,10 +985,10 @@ func (fm *Fm) Home() {
 }
 
 func (fm *Fm) Back() {
-	if fm.path != "/" {
+	if fm.path != "/" && !isRemoteRoot(fm.path) {
 		newPath := filepath.Dir(fm.path)
 
-		items, err := listDir(newPath)
+		items, err := fm.ListDir(newPath)
 		if err != nil {
 			fm.message = err
 			return
@@ -556,8 +1003,12 @@ func (fm *Fm) Back() {
 
 func (fm *Fm) Enter(program string) {
 	if len(fm.items) > 0 {
-		if fm.items[fm.cursor].isDir && len(program) == 0 {
-			items, err := listDir(fm.items[fm.cursor].path)
+		item := fm.items[fm.cursor]
+		format, _ := archiveFormat(item.name)
+		isArchive := format != ARCHIVE_NONE && !item.isDir && !item.isBroken && fm.filesystems.IsLocal(item.path)
+
+		if (item.isDir || isArchive) && len(program) == 0 {
+			items, err := fm.ListDir(fm.items[fm.cursor].path)
 			if err != nil {
 				fm.message = err
 			} else {
@@ -577,22 +1028,40 @@ func (fm *Fm) Enter(program string) {
 				}
 			}
 
+			path := item.path
+			if !fm.filesystems.IsLocal(path) {
+				var err error
+				if path, err = fm.TemporaryCopy(path); err != nil {
+					fm.message = err
+					return
+				}
+			}
+
 			gc.End()
 			fm.tty.Close()
 
-			cmd := exec.Command(program, fm.items[fm.cursor].path)
+			cmd := exec.Command(program, path)
 			cmd.Stdin = os.Stdin
 			cmd.Stdout = os.Stdout
 			fm.message = cmd.Run()
 
-			fm.tty, fm.window = terminalInit()
+			fm.tty, fm.screen = terminalInit(&fm.theme)
+			fm.Layout()
 		}
 	}
 }
 
+// Lists the directory again after changing it. Failing to, like when the
+// connection to a remote host drops, keeps the items as they were and reports
+// it, unless there already is an error to report.
 func (fm *Fm) Refresh() {
-	items, err := listDir(fm.path)
-	handleError(err)
+	items, err := fm.ListDir(fm.path)
+	if err != nil {
+		if fm.message == nil {
+			fm.message = err
+		}
+		return
+	}
 	fm.items = items
 }
 
@@ -620,38 +1089,253 @@ func (fm *Fm) ToggleAndMoveDown() {
 	}
 }
 
-func copyFile(srcpath, dstpath string) error {
-	src, err := os.Open(srcpath)
+func (fm *Fm) MarkWhere(pred func(Item) bool, mark bool) int {
+	changed := 0
+	for _, item := range fm.items {
+		if !pred(item) {
+			continue
+		}
+
+		if _, ok := fm.marked[item.path]; ok != mark {
+			if mark {
+				fm.marked[item.path] = item.isDir
+			} else {
+				delete(fm.marked, item.path)
+			}
+			changed++
+		}
+	}
+
+	return changed
+}
+
+func (fm *Fm) MarkPattern(mark bool) {
+	query := "Mark: "
+	if !mark {
+		query = "Unmark: "
+	}
+
+	pattern, ok := fm.Prompt(query, "", nil, nil, HISTORY_FILTER)
+	if !ok || pattern == "" {
+		return
+	}
+
+	match, err := compileFilter(pattern)
+	if err != nil {
+		fm.message = err
+		return
+	}
+
+	changed := fm.MarkWhere(func(item Item) bool {
+		return match(item.name)
+	}, mark)
+
+	if mark {
+		fm.notice = "Marked " + strconv.Itoa(changed) + " item(s)"
+	} else {
+		fm.notice = "Unmarked " + strconv.Itoa(changed) + " item(s)"
+	}
+}
+
+func (fm *Fm) MarkCommand(ch gc.Key) {
+	switch ch {
+	case 'm':
+		fm.MarkPattern(true)
+
+	case 'u':
+		fm.MarkPattern(false)
+
+	case 'i':
+		for index := range fm.items {
+			fm.ToggleMark(index)
+		}
+		fm.notice = "Toggled " + strconv.Itoa(len(fm.items)) + " item(s)"
+
+	case 'l':
+		fm.MarkedManager()
+
+	case 'c':
+		fm.notice = "Cleared " + strconv.Itoa(len(fm.marked)) + " mark(s)"
+		fm.marked = make(map[string]bool)
+
+	case 'f':
+		changed := fm.MarkWhere(func(item Item) bool {
+			return !item.isDir
+		}, true)
+		fm.notice = "Marked " + strconv.Itoa(changed) + " file(s)"
+
+	case 'd':
+		changed := fm.MarkWhere(func(item Item) bool {
+			return item.isDir
+		}, true)
+		fm.notice = "Marked " + strconv.Itoa(changed) + " dir(s)"
+
+	case 27:
+		return
+
+	default:
+		fm.message = errors.New("unknown mark command '" + gc.KeyString(ch) + "'")
+	}
+}
+
+// Returns an empty range (start > end) when visual mode is not active
+func (fm *Fm) VisualRange() (int, int) {
+	if !fm.visual || len(fm.items) == 0 {
+		return 0, -1
+	}
+
+	start := min(fm.visualStart, len(fm.items)-1)
+	end := fm.cursor
+	if start > end {
+		start, end = end, start
+	}
+
+	return start, end
+}
+
+// Returns true if the key was consumed by visual mode. Motions are left to the
+// regular handlers, every other key leaves visual mode before being handled.
+func (fm *Fm) VisualCommand(ch gc.Key) bool {
+	switch ch {
+	case 'x', 'u', gc.KEY_RETURN:
+		start, end := fm.VisualRange()
+		changed := 0
+		for i := start; i <= end; i++ {
+			item := &fm.items[i]
+			if _, ok := fm.marked[item.path]; ok == (ch == 'u') {
+				if ch == 'u' {
+					delete(fm.marked, item.path)
+				} else {
+					fm.marked[item.path] = item.isDir
+				}
+				changed++
+			}
+		}
+
+		if ch == 'u' {
+			fm.notice = "Unmarked " + strconv.Itoa(changed) + " item(s)"
+		} else {
+			fm.notice = "Marked " + strconv.Itoa(changed) + " item(s)"
+		}
+
+		fm.visual = false
+		return true
+
+	case 'V', 27:
+		fm.visual = false
+		return true
+
+	case 'j', 'k', '}', '{', 'g', 'G', 'n', 'N', '/', '?', 'H', gc.KEY_BACKSPACE,
+		'e' & 0x1f, 'y' & 0x1f, 'd' & 0x1f, 'u' & 0x1f, 'l' & 0x1f:
+		return false
+	}
+
+	if !unicode.IsDigit(rune(ch)) {
+		fm.visual = false
+	}
+
+	return false
+}
+
+func copyFile(filesystems *Filesystems, srcpath, dstpath string) error {
+	src, err := filesystems.For(srcpath).Open(srcpath)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
 
-	dst, err := os.Create(dstpath)
+	dst, err := filesystems.For(dstpath).Create(dstpath, os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
 	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
 
-func (fm *Fm) MarkedPromptAndPopup(action string) (string, []string) {
+func deleteItems(filesystems *Filesystems, items map[string]bool) error {
+	for item := range items {
+		if err := filesystems.For(item).Remove(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveItems(filesystems *Filesystems, items map[string]bool, dir string) error {
+	// Items can't be removed from archives after being copied out of them
+	for item := range items {
+		if _, ok := filesystems.For(item).(archiveFilesystem); ok {
+			return errReadOnlyArchive
+		}
+	}
+
+	for item := range items {
+		dst := filepath.Join(dir, filepath.Base(item))
+		if filesystem := filesystems.For(item); filesystem == filesystems.For(dst) {
+			if err := filesystem.Rename(item, dst); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Moving between filesystems, like from the disk to a remote host
+		if err := copyTree(filesystems, item, dst); err != nil {
+			return err
+		}
+
+		if err := filesystems.For(item).Remove(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyItems(filesystems *Filesystems, items map[string]bool, dir string) error {
+	for item := range items {
+		dst := filepath.Join(dir, filepath.Base(item))
+		if dst == item {
+			return errors.New("cannot copy '" + filepath.Base(item) + "' onto itself")
+		}
+
+		// Copying members out of archives onto the disk extracts them
+		if _, ok := filesystems.For(item).(archiveFilesystem); ok && filesystems.IsLocal(dst) {
+			archive, member, err := resolveArchivePath(item, false)
+			if err != nil {
+				return err
+			}
+
+			if err := extractMembers(context.Background(), archive, member, dir, &Progress{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := copyTree(filesystems, item, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fm *Fm) MarkedPromptAndPopup(action string, marked map[string]bool) (string, []string) {
 	var prompt string
 	var popupLines []string = nil
-	if len(fm.marked) == 1 {
+	if len(marked) == 1 {
 		prefix := fm.path
 		if prefix != "/" {
 			prefix += "/"
 		}
 
-		for item := range fm.marked {
+		for item := range marked {
 			prompt = action + " '" + strings.TrimPrefix(item, prefix) + "'"
 			break
 		}
 	} else {
-		prompt = action + " " + strconv.Itoa(len(fm.marked)) + " item(s)"
+		prompt = action + " " + strconv.Itoa(len(marked)) + " item(s)"
 
 		prefix := fm.path
 		if prefix != "/" {
@@ -659,7 +1343,7 @@ func (fm *Fm) MarkedPromptAndPopup(action string) (string, []string) {
 		}
 
 		popupItems := []Item{}
-		for item, isDir := range fm.marked {
+		for item, isDir := range marked {
 			popupItems = append(popupItems, Item{
 				name:  strings.TrimPrefix(item, prefix),
 				isDir: isDir,
@@ -711,13 +1395,21 @@ func (fm *Fm) MoveViewDown(stableCursor bool) {
 	}
 }
 
-func (fm *Fm) RunApp() {
+// Returns the pane to continue with when the focus moves to another pane, or
+// nil when quitting
+func (fm *Fm) RunApp() *Fm {
 	for {
 		ch := fm.window.GetChar()
 
+		if fm.visual && fm.VisualCommand(ch) {
+			fm.count = 0
+			fm.Render()
+			continue
+		}
+
 		switch ch {
 		case 'q':
-			return
+			return nil
 
 		case 'H':
 			fm.Render()
@@ -740,10 +1432,40 @@ func (fm *Fm) RunApp() {
 				"f    Create a file",
 				"x    Toggle mark for the item under the cursor",
 				"X    Toggle marks in the current directory",
+				"V    Start a visual selection",
+				"Mm   Mark items matching a pattern",
+				"Mu   Unmark items matching a pattern",
+				"Mi   Invert marks in the current directory",
+				"Ml   List all marked items",
+				"Mc   Clear all marks",
+				"Mf   Mark all files in the current directory",
+				"Md   Mark all directories in the current directory",
+				"\"as  Save marks into register a",
+				"\"aa  Add marks to register a",
+				"\"ar  Replace marks with register a",
+				"\"au  Add register a to marks",
+				"\"ac  Copy items in register a into the current directory",
+				"\"am  Move items in register a into the current directory",
+				"\"aD  Delete items in register a",
+				"\"ax  Clear register a",
 				"D    Delete marked items, otherwise item under the cursor",
 				"m    Move marked items into the current directory",
 				"c    Copy marked items into the current directory",
+				"s    Split the screen into two panes, or unsplit it",
+				"Tab  Switch to the other pane",
 				"r    Rename item under the cursor",
+				"La   Symlink marked items into the current directory",
+				"Lr   Symlink marked items into the current directory relatively",
+				"Lh   Hard link marked items into the current directory",
+				"Lf   Jump to the target of the symbolic link under the cursor",
+				"ax   Extract the archive under the cursor",
+				"ac   Compress marked items, otherwise item under the cursor",
+				"yy   Yank marked items, otherwise item under the cursor",
+				"yd   Cut marked items, otherwise item under the cursor",
+				"p    Paste yanked or cut items into the current directory",
+				"yp   Copy the paths of the items to the system clipboard",
+				"yn   Copy the names of the items to the system clipboard",
+				"yP   Copy the parent directories of the items to the system clipboard",
 				"~    Goto `$HOME`",
 				".    Goto the directory `fm` was opened in",
 				"-    Goto the previous active directory",
@@ -752,6 +1474,8 @@ func (fm *Fm) RunApp() {
 				"C-e  Move the view 1 item down",
 				"C-u  Move the view 10 items up",
 				"C-d  Move the view 10 items down",
+				"C-l  Clear search highlighting",
+				"F    Filter items in the current directory",
 			}, nil)
 
 		case 'j':
@@ -840,39 +1564,52 @@ func (fm *Fm) RunApp() {
 			fm.PrevDir()
 
 		case 'o':
-			query, ok := fm.Prompt("Open: ", "", nil)
+			query, ok := fm.Prompt("Open: ", "", nil, fm.CompleteProgram, HISTORY_OPEN)
 			if ok {
 				fm.Enter(query)
 			}
 
 		case '/':
 			cursor := fm.cursor
+			prevQuery, prevReverse, prevHighlight := fm.searchQuery, fm.searchReverse, fm.searchHighlight
 			_, ok := fm.Prompt("/", "", func(query string) bool {
 				fm.cursor = cursor
 				fm.searchQuery = query
 				fm.searchReverse = false
+				fm.searchHighlight = query != ""
 				return fm.FindQuery(query, cursor)
-			})
+			}, nil, HISTORY_SEARCH)
 
 			if !ok {
 				fm.cursor = cursor
+				fm.searchQuery, fm.searchReverse, fm.searchHighlight = prevQuery, prevReverse, prevHighlight
 			}
 
 		case '?':
 			cursor := fm.cursor
+			prevQuery, prevReverse, prevHighlight := fm.searchQuery, fm.searchReverse, fm.searchHighlight
 			_, ok := fm.Prompt("?", "", func(query string) bool {
 				fm.cursor = cursor
 				fm.searchQuery = query
 				fm.searchReverse = true
+				fm.searchHighlight = query != ""
 				return fm.FindQueryReverse(query, fm.cursor)
-			})
+			}, nil, HISTORY_SEARCH)
 
 			if !ok {
 				fm.cursor = cursor
+				fm.searchQuery, fm.searchReverse, fm.searchHighlight = prevQuery, prevReverse, prevHighlight
 			}
 
+		case 'l' & 0x1f:
+			fm.searchHighlight = false
+
+		case 'F':
+			fm.Filter()
+
 		case 'n':
 			if len(fm.searchQuery) > 0 {
+				fm.searchHighlight = true
 				first := -1
 				count := max(1, fm.count)
 				for i := 0; i < count; i++ {
@@ -894,6 +1631,7 @@ func (fm *Fm) RunApp() {
 
 		case 'N':
 			if len(fm.searchQuery) > 0 {
+				fm.searchHighlight = true
 				first := -1
 				count := max(1, fm.count)
 				for i := 0; i < count; i++ {
@@ -914,27 +1652,23 @@ func (fm *Fm) RunApp() {
 			}
 
 		case 'd':
-			query, ok := fm.Prompt("Create Dir: ", "", nil)
-			if ok {
-				fm.message = os.MkdirAll(filepath.Join(fm.path, query), 0750)
+			if !fm.CheckWritable(fm.path) {
+				break
+			}
 
-				if fm.message == nil {
-					fm.Refresh()
-					fm.FindExact(query)
-				}
+			query, ok := fm.Prompt("Create Dir: ", "", nil, fm.CompletePath, HISTORY_CREATE)
+			if ok && query != "" {
+				fm.Create(query, true)
 			}
 
 		case 'f':
-			query, ok := fm.Prompt("Create File: ", "", nil)
-			if ok {
-				file, err := os.OpenFile(filepath.Join(fm.path, query), os.O_RDONLY|os.O_CREATE, 0644)
-				fm.message = err
+			if !fm.CheckWritable(fm.path) {
+				break
+			}
 
-				if fm.message == nil {
-					file.Close()
-					fm.Refresh()
-					fm.FindExact(query)
-				}
+			query, ok := fm.Prompt("Create File: ", "", nil, fm.CompletePath, HISTORY_CREATE)
+			if ok && query != "" {
+				fm.Create(query, false)
 			}
 
 		case 'x':
@@ -945,6 +1679,50 @@ func (fm *Fm) RunApp() {
 				fm.ToggleMark(index)
 			}
 
+		case '"':
+			fm.window.MovePrint(fm.height-1, 0, "\"")
+			fm.window.ClearToEOL()
+			fm.window.Refresh()
+
+			name := fm.window.GetChar()
+			fm.window.MovePrint(fm.height-1, 0, "\""+gc.KeyString(name))
+			fm.window.Refresh()
+
+			fm.RegisterCommand(name, fm.window.GetChar())
+
+		case 'y':
+			fm.window.MovePrint(fm.height-1, 0, "y")
+			fm.window.ClearToEOL()
+			fm.window.Refresh()
+			fm.YankCommand(fm.window.GetChar())
+
+		case 'p':
+			fm.Paste()
+
+		case 'a':
+			fm.window.MovePrint(fm.height-1, 0, "a")
+			fm.window.ClearToEOL()
+			fm.window.Refresh()
+			fm.ArchiveCommand(fm.window.GetChar())
+
+		case 'L':
+			fm.window.MovePrint(fm.height-1, 0, "L")
+			fm.window.ClearToEOL()
+			fm.window.Refresh()
+			fm.LinkCommand(fm.window.GetChar())
+
+		case 'V':
+			if len(fm.items) > 0 {
+				fm.visual = true
+				fm.visualStart = fm.cursor
+			}
+
+		case 'M':
+			fm.window.MovePrint(fm.height-1, 0, "M")
+			fm.window.ClearToEOL()
+			fm.window.Refresh()
+			fm.MarkCommand(fm.window.GetChar())
+
 		case 'D':
 			deleted := false
 			toggleStart := -1
@@ -956,15 +1734,14 @@ func (fm *Fm) RunApp() {
 				fm.Render()
 			}
 
+			if len(fm.marked) == 0 && !fm.CheckWritable(fm.path) {
+				break
+			}
+
 			if len(fm.marked) > 0 {
-				if fm.Confirm(fm.MarkedPromptAndPopup("Delete")) {
+				if fm.Confirm(fm.MarkedPromptAndPopup("Delete", fm.marked)) {
 					deleted = true
-					for item := range fm.marked {
-						fm.message = os.RemoveAll(item)
-						if fm.message != nil {
-							break
-						}
-					}
+					fm.message = deleteItems(fm.filesystems, fm.marked)
 				} else if toggleStart != -1 {
 					fm.ToggleAndMoveDown()
 					fm.cursor = toggleStart
@@ -972,7 +1749,8 @@ func (fm *Fm) RunApp() {
 			} else if len(fm.items) > 0 {
 				if fm.Confirm("Delete '"+fm.items[fm.cursor].name+"'", nil) {
 					deleted = true
-					fm.message = os.RemoveAll(fm.items[fm.cursor].path)
+					path := fm.items[fm.cursor].path
+					fm.message = fm.filesystems.For(path).Remove(path)
 				}
 			}
 
@@ -983,48 +1761,31 @@ func (fm *Fm) RunApp() {
 			}
 
 		case 'm':
-			if len(fm.marked) > 0 {
-				if fm.Confirm(fm.MarkedPromptAndPopup("Move")) {
-					for item := range fm.marked {
-						fm.message = os.Rename(item, filepath.Join(fm.path, filepath.Base(item)))
-						if fm.message != nil {
-							break
-						}
-					}
-
-					fm.Refresh()
-					fm.marked = make(map[string]bool)
-				}
-			}
+			fm.Transfer(true)
 
 		case 'c':
-			if len(fm.marked) > 0 {
-				if fm.Confirm(fm.MarkedPromptAndPopup("Copy")) {
-					for item := range fm.marked {
-						fm.message = copyFile(item, filepath.Join(fm.path, filepath.Base(item)))
-						if fm.message != nil {
-							break
-						}
-					}
+			fm.Transfer(false)
 
-					fm.Refresh()
-					fm.marked = make(map[string]bool)
-				}
-			}
+		case 's':
+			fm.ToggleSplit()
+
+		case '\t':
+			fm.SwitchPane()
+
+		case gc.KEY_RESIZE:
+			fm.Layout()
 
 		case 'r':
-			if len(fm.items) > 0 {
-				finalName, ok := fm.Prompt("Rename: ", fm.items[fm.cursor].name, nil)
+			if len(fm.items) > 0 && fm.CheckWritable(fm.path) {
+				finalName, ok := fm.Prompt("Rename: ", fm.items[fm.cursor].name, nil, fm.CompletePath, HISTORY_RENAME)
 
 				if ok {
-					fm.message = os.Rename(
-						fm.items[fm.cursor].path,
-						filepath.Join(fm.path, finalName),
-					)
+					path := fm.items[fm.cursor].path
+					fm.message = fm.filesystems.For(path).Rename(path, fm.ExpandPath(finalName))
 				}
 
 				fm.Refresh()
-				fm.FindExact(finalName)
+				fm.FindContaining(fm.ExpandPath(finalName))
 			}
 		}
 
@@ -1035,6 +1796,9 @@ func (fm *Fm) RunApp() {
 		}
 
 		fm.Render()
+		if fm.active != fm {
+			return fm.active
+		}
 	}
 }
 
@@ -1098,11 +1862,17 @@ func main() {
 	}
 
 	fm := fmInit(initPath)
-	fm.RunApp()
+	for next := fm; next != nil; next = fm.RunApp() {
+		fm = next
+	}
 
 	gc.End()
 	fm.tty.Close()
+	fm.filesystems.Close()
+	if fm.tempDir != "" {
+		os.RemoveAll(fm.tempDir)
+	}
 	if lastPath {
-		syscall.Write(originalStdoutFd, []byte(fm.path+"\n"))
+		syscall.Write(originalStdoutFd, []byte(displayPath(fm.path)+"\n"))
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+func humanSize(size int64) string {
+	const units = "KMGTPE"
+
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	value := float64(size)
+	unit := -1
+	for value >= 1024 && unit+1 < len(units) {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+// Symbolic links count as themselves rather than what they point to, and
+// anything that cannot be read counts as nothing. The only error is getting
+// cancelled, since huge directories or remote ones can take a while.
+func pathSize(ctx context.Context, filesystems *Filesystems, path string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	info, err := filesystems.For(path).Stat(path)
+	if err != nil {
+		return 0, nil
+	} else if !info.IsDir() {
+		return info.Size(), nil
+	}
+
+	items, err := filesystems.List(path)
+	if err != nil {
+		return 0, nil
+	}
+
+	var size int64
+	for _, item := range items {
+		itemSize, err := pathSize(ctx, filesystems, item.path)
+		if err != nil {
+			return 0, err
+		}
+		size += itemSize
+	}
+	return size, nil
+}
+
+// Sorted by parent directory first, so items in the same directory are grouped
+func sortedMarked(marked map[string]bool) []string {
+	paths := make([]string, 0, len(marked))
+	for path := range marked {
+		paths = append(paths, path)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := filepath.Dir(paths[i]), filepath.Dir(paths[j])
+		if di != dj {
+			return di < dj
+		}
+
+		if marked[paths[i]] != marked[paths[j]] {
+			return marked[paths[i]]
+		}
+
+		return paths[i] < paths[j]
+	})
+
+	return paths
+}
+
+type markedLine struct {
+	text  string
+	path  string // Empty for directory headers
+	isDir bool
+}
+
+// Cancelling the measuring of the sizes still shows the items, just without
+// the sizes that are missing
+func (fm *Fm) MarkedManager() {
+	sizes := make(map[string]int64)
+	err := fm.RunCancellable("Measuring", func(ctx context.Context, progress *Progress) error {
+		for path := range fm.marked {
+			progress.Set(displayPath(path))
+			size, err := pathSize(ctx, fm.filesystems, path)
+			if err != nil {
+				return err
+			}
+			sizes[path] = size
+		}
+		return nil
+	})
+
+	cursor := 0
+	anchor := 0
+	for {
+		if len(fm.marked) == 0 {
+			fm.notice = "No marked items"
+			return
+		}
+
+		paths := sortedMarked(fm.marked)
+		cursor = max(min(cursor, len(paths)-1), 0)
+
+		var total int64
+		lines := []markedLine{}
+		cursorLine := 0
+		for i, path := range paths {
+			dir := filepath.Dir(path)
+			if i == 0 || filepath.Dir(paths[i-1]) != dir {
+				lines = append(lines, markedLine{text: displayPath(dir)})
+			}
+
+			if i == cursor {
+				cursorLine = len(lines)
+			}
+
+			name := "  " + filepath.Base(path)
+			if fm.marked[path] {
+				name += "/"
+			}
+
+			lines = append(lines, markedLine{text: name, path: path, isDir: fm.marked[path]})
+			total += sizes[path]
+		}
+
+		var width int
+		fm.height, width = fm.window.MaxYX()
+		rows := fm.height - 2
+
+		if cursorLine >= anchor+rows {
+			anchor = cursorLine - rows + 1
+		}
+
+		// Keep the directory header of the first item in view
+		if cursorLine-1 < anchor {
+			anchor = max(cursorLine-1, 0)
+		}
+
+		fm.window.Erase()
+		fm.StyleOn(COLOR_TITLE)
+		if err == nil {
+			fm.window.Printf("Marked: %d item(s), %s", len(paths), humanSize(total))
+		} else {
+			fm.window.Printf("Marked: %d item(s)", len(paths))
+		}
+		fm.StyleOff(COLOR_TITLE)
+
+		last := min(len(lines), anchor+rows)
+		for i := anchor; i < last; i++ {
+			line := lines[i]
+			y := i - anchor + 1
+
+			if line.path == "" {
+				fm.window.AttrOn(gc.A_BOLD)
+				fm.window.MovePrint(y, 0, line.text)
+				fm.window.AttrOff(gc.A_BOLD)
+				continue
+			}
+
+			element := int16(COLOR_FILE)
+			if line.isDir {
+				element = COLOR_DIR
+			}
+
+			if i == cursorLine {
+				element = COLOR_CURSOR
+			}
+
+			fm.StyleOn(element)
+			fm.window.MovePrint(y, 0, line.text)
+			fm.StyleOff(element)
+
+			if size, ok := sizes[line.path]; ok {
+				text := humanSize(size)
+				fm.window.MovePrint(y, max(width-len(text)-1, len(line.text)+1), text)
+			}
+		}
+
+		fm.window.MovePrint(fm.height-1, 0, "x: unmark, l: jump to item, q: close")
+		fm.window.Refresh()
+
+		switch fm.window.GetChar() {
+		case 'j':
+			if cursor+1 < len(paths) {
+				cursor++
+			}
+
+		case 'k':
+			if cursor > 0 {
+				cursor--
+			}
+
+		case 'g':
+			cursor = 0
+
+		case 'G':
+			cursor = len(paths) - 1
+
+		case '}', 'd' & 0x1f:
+			cursor = min(cursor+BRACE_MOVE_COUNT, len(paths)-1)
+
+		case '{', 'u' & 0x1f:
+			cursor = max(cursor-BRACE_MOVE_COUNT, 0)
+
+		case 'x', 'd':
+			delete(fm.marked, paths[cursor])
+
+		case 'l', gc.KEY_RETURN:
+			path := paths[cursor]
+			if _, err := fm.filesystems.For(path).Stat(path); err != nil {
+				fm.message = err
+				return
+			}
+
+			if dir := filepath.Dir(path); dir != fm.path {
+				fm.GotoDir(dir)
+			}
+			fm.FindExact(filepath.Base(path))
+			return
+
+		case 'q', 27:
+			return
+		}
+	}
+}
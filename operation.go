@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+var errCancelled = errors.New("cancelled")
+
+// Progress reported by a running operation, safe to update from its goroutine
+type Progress struct {
+	mutex  sync.Mutex
+	status string
+}
+
+func (p *Progress) Set(status string) {
+	p.mutex.Lock()
+	p.status = status
+	p.mutex.Unlock()
+}
+
+func (p *Progress) Get() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// Runs the work in the background while showing its progress in the status
+// line, until it finishes or gets cancelled with Escape or C-c. Curses must
+// not be touched by the work.
+func (fm *Fm) RunCancellable(title string, work func(ctx context.Context, progress *Progress) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progress := &Progress{}
+	done := make(chan error, 1)
+	go func() {
+		done <- work(ctx, progress)
+	}()
+
+	fm.window.Timeout(100)
+	defer fm.window.Timeout(-1)
+
+	for {
+		select {
+		case err := <-done:
+			if ctx.Err() != nil {
+				return errCancelled
+			}
+			return err
+
+		default:
+		}
+
+		height, width := fm.window.MaxYX()
+		fm.StyleOn(COLOR_STATUS)
+		fm.window.MovePrint(height-1, 0, truncateWidth(title+": "+progress.Get()+" (Esc to cancel)", width-1))
+		fm.StyleOff(COLOR_STATUS)
+		fm.window.ClearToEOL()
+		fm.window.Refresh()
+
+		switch fm.window.GetChar() {
+		case 27, 'c' & 0x1f:
+			cancel()
+
+		case gc.KEY_RESIZE:
+			fm.Layout()
+			fm.Render()
+		}
+	}
+}
+
+// Copies from src to dst, bailing out as soon as the context is cancelled
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buffer := make([]byte, 32*1024)
+
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, err := src.Read(buffer)
+		if n > 0 {
+			m, err := dst.Write(buffer[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
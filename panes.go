@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+// Splits the screen between the panes side by side, or gives all of it to the
+// only one. The active pane is left to be rendered by the caller.
+//
+// Only the windows made here are deleted, since the screen is replaced by a
+// different *gc.Window wrapping the same curses window after running programs.
+func (s *Session) Layout() {
+	height, width := s.screen.MaxYX()
+	left := width / 2
+
+	for index, pane := range s.panes {
+		if pane.ownsWindow {
+			pane.window.Delete()
+		}
+
+		if len(s.panes) == 1 {
+			pane.window = s.screen
+			pane.ownsWindow = false
+			continue
+		}
+
+		x, paneWidth := 0, left
+		if index == 1 {
+			x, paneWidth = left, width-left
+		}
+
+		window, err := gc.NewWindow(height, paneWidth, 0, x)
+		handleError(err)
+		window.Keypad(true)
+		pane.window = window
+		pane.ownsWindow = true
+	}
+
+	for _, pane := range s.panes {
+		if pane != s.active {
+			pane.Render()
+		}
+	}
+}
+
+func (fm *Fm) OtherPane() *Fm {
+	for _, pane := range fm.panes {
+		if pane != fm {
+			return pane
+		}
+	}
+	return nil
+}
+
+// Splits the screen into two panes showing the current directory, or goes
+// back to only showing the active pane. Items marked in the other pane stay
+// marked, rather than being lost along with it.
+func (fm *Fm) ToggleSplit() {
+	if other := fm.OtherPane(); other != nil {
+		if added := unionMarked(fm.marked, other.marked); added > 0 {
+			fm.notice = "Kept " + strconv.Itoa(added) + " marked item(s) from the other pane"
+		}
+
+		other.window.Delete()
+		other.ownsWindow = false
+		fm.panes = []*Fm{fm}
+	} else {
+		fm.panes = append(fm.panes, &Fm{
+			Session:  fm.Session,
+			path:     fm.path,
+			pathInit: fm.pathInit,
+			items:    slices.Clone(fm.items),
+			cursor:   fm.cursor,
+			marked:   make(map[string]bool),
+			history:  make(map[string]string),
+			filters:  maps.Clone(fm.filters),
+
+			showedInitHelpMessage: true,
+		})
+	}
+
+	fm.Layout()
+}
+
+func (fm *Fm) SwitchPane() {
+	other := fm.OtherPane()
+	if other == nil {
+		fm.message = errors.New("the screen is not split, press 's' to split it")
+		return
+	}
+
+	fm.active = other
+	other.Reload()
+	other.Render()
+}
+
+// Lists the directory again, since it may have been changed from the other
+// pane, keeping the cursor on the same item if it is still there
+func (fm *Fm) Reload() {
+	items, err := fm.ListDir(fm.path)
+	if err != nil {
+		fm.message = err
+		return
+	}
+
+	name := ""
+	if fm.cursor < len(fm.items) {
+		name = fm.items[fm.cursor].name
+	}
+
+	fm.items = items
+	fm.cursor = max(min(fm.cursor, len(fm.items)-1), 0)
+	fm.FindExact(name)
+}
+
+// Copies and moves go to the directory of the other pane when the screen is
+// split, otherwise to the current directory
+func (fm *Fm) Destination() string {
+	if other := fm.OtherPane(); other != nil {
+		return other.path
+	}
+	return fm.path
+}
+
+// Moves the items when asked to, otherwise copies them
+func (fm *Fm) Transfer(move bool) {
+	action, transfer := "Copy", copyItems
+	if move {
+		action, transfer = "Move", moveItems
+	}
+
+	items := fm.marked
+
+	// With another pane to send it to, the item under the cursor doesn't
+	// have to be marked first
+	if len(items) == 0 && fm.OtherPane() != nil && len(fm.items) > 0 {
+		item := fm.items[fm.cursor]
+		items = map[string]bool{item.path: item.isDir}
+	}
+
+	dest := fm.Destination()
+	if len(items) == 0 || !fm.CheckWritable(dest) || (move && !fm.CheckMovable(items)) {
+		return
+	}
+
+	prompt, popupLines := fm.MarkedPromptAndPopup(action, items)
+	if dest != fm.path {
+		prompt += " to '" + displayPath(dest) + "'"
+	}
+
+	if fm.Confirm(prompt, popupLines) {
+		fm.message = transfer(fm.filesystems, items, dest)
+
+		fm.Refresh()
+		fm.marked = make(map[string]bool)
+
+		if other := fm.OtherPane(); other != nil {
+			other.Reload()
+			other.Render()
+		}
+	}
+}
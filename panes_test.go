@@ -0,0 +1,145 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// The test binary runs fm itself when asked to, so that it can be driven from
+// a terminal the tests control
+func TestMain(m *testing.M) {
+	if dir := os.Getenv("FM_TEST_MAIN"); dir != "" {
+		os.Args = []string{"fm", dir}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Opens a pseudo terminal of the given size, returning both ends of it
+func openPty(t *testing.T, rows, cols uint16) (*os.File, *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		t.Fatal(err)
+	}
+
+	var index uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&index)); err != nil {
+		t.Fatal(err)
+	}
+
+	size := [4]uint16{rows, cols, 0, 0}
+	if err := ioctl(master.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&size)); err != nil {
+		t.Fatal(err)
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(index)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+
+	return master, slave
+}
+
+type ptyOutput struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (o *ptyOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buffer.Write(p)
+}
+
+func (o *ptyOutput) Contains(text string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return strings.Contains(o.buffer.String(), text)
+}
+
+func (o *ptyOutput) WaitFor(t *testing.T, text string) {
+	for deadline := time.Now().Add(10 * time.Second); !o.Contains(text); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q", text)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Running a program used to delete the screen along with the window of the
+// only pane, crashing fm on the next draw
+func TestEnterSinglePane(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	master, slave := openPty(t, 24, 80)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"FM_TEST_MAIN="+dir,
+		"HOME="+dir,
+		"XDG_CONFIG_HOME="+filepath.Join(dir, "config"),
+		"XDG_DATA_HOME="+filepath.Join(dir, "data"),
+		"TERM=xterm",
+		"EDITOR=true",
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	output := &ptyOutput{}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(output, master)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	output.WaitFor(t, "Press H")
+	for _, keys := range []string{"e", "otrue\r", "q"} {
+		if _, err := master.WriteString(keys); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil || output.Contains("SIGSEGV") {
+			t.Fatalf("fm failed: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("fm did not quit")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+func dataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "fm"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".local", "share", "fm"), nil
+}
+
+func registersPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "registers.json"), nil
+}
+
+func loadRegisters() (map[string]map[string]bool, error) {
+	registers := make(map[string]map[string]bool)
+
+	path, err := registersPath()
+	if err != nil {
+		return registers, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registers, nil
+	} else if err != nil {
+		return registers, err
+	}
+
+	if err := json.Unmarshal(data, &registers); err != nil {
+		return make(map[string]map[string]bool), errors.New("could not parse '" + path + "': " + err.Error())
+	}
+
+	return registers, nil
+}
+
+func (fm *Fm) SaveRegisters() error {
+	path, err := registersPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(fm.registers)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func unionMarked(dst map[string]bool, src map[string]bool) int {
+	added := 0
+	for path, isDir := range src {
+		if _, ok := dst[path]; !ok {
+			dst[path] = isDir
+			added++
+		}
+	}
+	return added
+}
+
+func (fm *Fm) RegisterCommand(name gc.Key, action gc.Key) {
+	if name < 'a' || name > 'z' {
+		fm.message = errors.New("invalid register '" + gc.KeyString(name) + "'")
+		return
+	}
+
+	register := string(rune(name))
+	items := fm.registers[register]
+	count := strconv.Itoa(len(items))
+
+	switch action {
+	case 's', 'a', 'x':
+	case 'r', 'u', 'c', 'm', 'D':
+		if len(items) == 0 {
+			fm.message = errors.New("register '" + register + "' is empty")
+			return
+		}
+
+	case 27:
+		return
+
+	default:
+		fm.message = errors.New("unknown register command '" + gc.KeyString(action) + "'")
+		return
+	}
+
+	switch action {
+	case 's':
+		fm.registers[register] = make(map[string]bool)
+		unionMarked(fm.registers[register], fm.marked)
+		fm.notice = "Saved " + strconv.Itoa(len(fm.marked)) + " item(s) into register '" + register + "'"
+
+	case 'a':
+		if items == nil {
+			fm.registers[register] = make(map[string]bool)
+		}
+		added := unionMarked(fm.registers[register], fm.marked)
+		fm.notice = "Added " + strconv.Itoa(added) + " item(s) to register '" + register + "'"
+
+	case 'x':
+		delete(fm.registers, register)
+		fm.notice = "Cleared register '" + register + "'"
+
+	case 'r':
+		fm.marked = make(map[string]bool)
+		unionMarked(fm.marked, items)
+		fm.notice = "Restored " + count + " item(s) from register '" + register + "'"
+		return
+
+	case 'u':
+		added := unionMarked(fm.marked, items)
+		fm.notice = "Added " + strconv.Itoa(added) + " item(s) from register '" + register + "'"
+		return
+
+	case 'c':
+		if fm.CheckWritable(fm.path) && fm.Confirm(fm.MarkedPromptAndPopup("Copy", items)) {
+			fm.message = copyItems(fm.filesystems, items, fm.path)
+			fm.Refresh()
+		}
+		return
+
+	case 'm':
+		if !fm.CheckWritable(fm.path) || !fm.CheckMovable(items) || !fm.Confirm(fm.MarkedPromptAndPopup("Move", items)) {
+			return
+		}
+
+		fm.message = moveItems(fm.filesystems, items, fm.path)
+		fm.Refresh()
+
+		// Keep tracking the items that made it to their new location
+		moved := make(map[string]bool)
+		for item, isDir := range items {
+			path := filepath.Join(fm.path, filepath.Base(item))
+			if _, err := fm.filesystems.For(path).Stat(path); err == nil {
+				moved[path] = isDir
+			} else {
+				moved[item] = isDir
+			}
+		}
+		fm.registers[register] = moved
+
+	case 'D':
+		if !fm.Confirm(fm.MarkedPromptAndPopup("Delete", items)) {
+			return
+		}
+
+		fm.message = deleteItems(fm.filesystems, items)
+		fm.Refresh()
+		fm.cursor = max(min(fm.cursor, len(fm.items)-1), 0)
+		delete(fm.registers, register)
+	}
+
+	if err := fm.SaveRegisters(); err != nil && fm.message == nil {
+		fm.message = err
+	}
+}
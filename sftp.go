@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	SFTP_SCHEME       = "sftp://"
+	SFTP_PREFIX       = "sftp:/"
+	SFTP_DEFAULT_PORT = "22"
+	SFTP_DIAL_TIMEOUT = 10 * time.Second
+)
+
+// Remote paths are kept as sftp:/user@host/path rather than the usual
+// sftp://user@host/path, since that is what cleaning the latter results in
+func splitRemotePath(fullPath string) (string, string, bool) {
+	if !strings.HasPrefix(fullPath, SFTP_PREFIX) {
+		return "", "", false
+	}
+
+	host, remote, _ := strings.Cut(strings.TrimLeft(fullPath[len(SFTP_PREFIX):], "/"), "/")
+	return host, "/" + remote, host != ""
+}
+
+func remotePath(host, remote string) string {
+	return filepath.Join(SFTP_PREFIX+host, remote)
+}
+
+func isRemoteRoot(fullPath string) bool {
+	_, remote, ok := splitRemotePath(fullPath)
+	return ok && remote == "/"
+}
+
+// Shows remote paths in the form they are written in
+func displayPath(fullPath string) string {
+	if host, remote, ok := splitRemotePath(fullPath); ok {
+		return SFTP_SCHEME + host + remote
+	}
+	return fullPath
+}
+
+// Authenticates with the keys in ssh-agent, and only connects to hosts that
+// are already in ~/.ssh/known_hosts
+func dialSftp(host string) (*sftp.Client, error) {
+	username, address := "", host
+	if index := strings.LastIndexByte(host, '@'); index != -1 {
+		username, address = host[:index], host[index+1:]
+	} else if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, SFTP_DEFAULT_PORT)
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("ssh-agent is not running, $SSH_AUTH_SOCK is not set")
+	}
+
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer agentConn.Close()
+
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := knownhosts.New(filepath.Join(homePath, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         SFTP_DIAL_TIMEOUT,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Turns sftp://user@host/path into the path used within fm. Without a path,
+// the home directory on the host is used.
+func parseRemoteURL(filesystems *Filesystems, url string) (string, error) {
+	host, remote, _ := strings.Cut(strings.TrimPrefix(url, SFTP_SCHEME), "/")
+	if host == "" {
+		return "", errors.New("no host in '" + url + "'")
+	}
+
+	if remote == "" {
+		client, err := filesystems.remote(host).client()
+		if err != nil {
+			return "", err
+		}
+
+		if remote, err = client.Getwd(); err != nil {
+			return "", err
+		}
+	}
+
+	return remotePath(host, "/"+remote), nil
+}
+
+// The files on a remote host, accessed over SFTP. The connection is made when
+// first needed, and kept open until fm exits.
+type sftpFilesystem struct {
+	host string
+	conn *sftp.Client // Used as is when already connected some other way
+}
+
+func (s *sftpFilesystem) client() (*sftp.Client, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	client, err := dialSftp(s.host)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn = client
+	return client, nil
+}
+
+func (s *sftpFilesystem) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Returns the client along with the path on the host
+func (s *sftpFilesystem) resolve(fullPath string) (*sftp.Client, string, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, remote, _ := splitRemotePath(fullPath)
+	return client, remote, nil
+}
+
+func (s *sftpFilesystem) List(fullPath string) ([]Item, error) {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := client.ReadDir(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, len(infos))
+	for index, info := range infos {
+		items[index] = Item{
+			name:  info.Name(),
+			path:  filepath.Join(fullPath, info.Name()),
+			isDir: info.IsDir(),
+			mode:  info.Mode(),
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			item := &items[index]
+			item.isLink = true
+			item.target, _ = client.ReadLink(path.Join(remote, info.Name()))
+
+			if info, err := client.Stat(path.Join(remote, info.Name())); err == nil {
+				item.isDir = info.IsDir()
+				item.targetMode = info.Mode()
+			} else {
+				item.isBroken = true
+			}
+		}
+	}
+
+	sortItems(items)
+	return items, nil
+}
+
+func (s *sftpFilesystem) Stat(fullPath string) (fs.FileInfo, error) {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Lstat(remote)
+}
+
+func (s *sftpFilesystem) Open(fullPath string) (io.ReadCloser, error) {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Open(remote)
+}
+
+func (s *sftpFilesystem) Create(fullPath string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|flag)
+	if err != nil {
+		// Servers only report a generic failure when the file already exists
+		if _, statErr := client.Lstat(remote); flag&os.O_EXCL != 0 && statErr == nil {
+			err = &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrExist}
+		}
+		return nil, err
+	}
+
+	// New files get the permissions from the umask of the server, which only
+	// leaves the executable bits to be added
+	if perm&0111 != 0 {
+		if err := file.Chmod(perm); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+func (s *sftpFilesystem) Mkdir(fullPath string, perm fs.FileMode) error {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return err
+	}
+
+	return client.MkdirAll(remote)
+}
+
+func (s *sftpFilesystem) Rename(oldPath, newPath string) error {
+	client, oldRemote, err := s.resolve(oldPath)
+	if err != nil {
+		return err
+	}
+
+	host, newRemote, ok := splitRemotePath(newPath)
+	if !ok || host != s.host {
+		return errors.New("cannot rename across hosts")
+	}
+
+	return client.PosixRename(oldRemote, newRemote)
+}
+
+func (s *sftpFilesystem) Remove(fullPath string) error {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return err
+	}
+
+	return client.RemoveAll(remote)
+}
+
+func (s *sftpFilesystem) Symlink(target, fullPath string) error {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return err
+	}
+
+	// Absolute targets within the same host are the paths on that host
+	if host, targetRemote, ok := splitRemotePath(target); ok && host == s.host {
+		target = targetRemote
+	}
+
+	return client.Symlink(target, remote)
+}
+
+func (s *sftpFilesystem) Readlink(fullPath string) (string, error) {
+	client, remote, err := s.resolve(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	return client.ReadLink(remote)
+}
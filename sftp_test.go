@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const SFTP_TEST_HOST = "test@pipe"
+
+// Serves the local disk over a pipe, with the client on the other end of it
+func pipeSftp(t *testing.T) *sftpFilesystem {
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sftpFilesystem{host: SFTP_TEST_HOST, conn: client}
+}
+
+// These tests run against a server within the test by default, which serves a
+// temporary directory on the local disk. Setting $FM_TEST_SFTP to a scratch
+// directory on a real SSH server, like sftp://user@localhost:2222/tmp, runs
+// them against that instead. Connecting works just like it does for fm, with
+// the keys in ssh-agent and the host in ~/.ssh/known_hosts.
+func sftpTestDir(t *testing.T) (*Filesystems, string) {
+	filesystems := newFilesystems()
+	t.Cleanup(filesystems.Close)
+
+	var root string
+	if url := os.Getenv("FM_TEST_SFTP"); url != "" {
+		var err error
+		if root, err = parseRemoteURL(filesystems, url); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		filesystems.Mount(remotePath(SFTP_TEST_HOST, "/"), pipeSftp(t))
+		root = remotePath(SFTP_TEST_HOST, t.TempDir())
+	}
+
+	dir := filepath.Join(root, "fm-test-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := filesystems.For(dir).Mkdir(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := filesystems.For(dir).Remove(dir); err != nil {
+			t.Error(err)
+		}
+	})
+	return filesystems, dir
+}
+
+func writeRemote(t *testing.T, filesystem Filesystem, path, contents string, perm fs.FileMode) {
+	file, err := filesystem.Create(path, os.O_TRUNC, perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(file, contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRemote(t *testing.T, filesystem Filesystem, path string) string {
+	file, err := filesystem.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSftpFilesystem(t *testing.T) {
+	filesystems, dir := sftpTestDir(t)
+	remote := filesystems.Within(dir)
+	if _, ok := remote.(*sftpFilesystem); !ok {
+		t.Fatalf("'%s' is not on a remote host", displayPath(dir))
+	}
+
+	file := filepath.Join(dir, "file")
+	writeRemote(t, remote, file, "contents", 0644)
+	if got := readRemote(t, remote, file); got != "contents" {
+		t.Errorf("got %q, want %q", got, "contents")
+	}
+
+	script := filepath.Join(dir, "script")
+	writeRemote(t, remote, script, "#!/bin/sh\n", 0755)
+
+	if info, err := remote.Stat(file); err != nil || info.Size() != int64(len("contents")) {
+		t.Errorf("stat of '%s' failed: %v", file, err)
+	}
+
+	if info, err := remote.Stat(script); err != nil || info.Mode().Perm()&0111 == 0 {
+		t.Errorf("'%s' is not executable: %v", script, err)
+	}
+
+	if _, err := remote.Create(file, os.O_EXCL, 0644); err == nil {
+		t.Error("creating an existing file exclusively succeeded")
+	}
+
+	sub := filepath.Join(dir, "sub", "deeper")
+	if err := remote.Mkdir(sub, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := remote.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := remote.Readlink(link); err != nil || target != "file" {
+		t.Errorf("got link to %q, %v, want %q", target, err, "file")
+	}
+
+	items, err := filesystems.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.name)
+		if item.path != filepath.Join(dir, item.name) {
+			t.Errorf("'%s' listed at '%s'", item.name, item.path)
+		}
+
+		if item.name == "link" && (!item.isLink || item.target != "file" || item.isDir) {
+			t.Errorf("link listed as %+v", item)
+		}
+	}
+
+	if got, want := strings.Join(names, " "), "sub file link script"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	renamed := filepath.Join(dir, "sub", "renamed")
+	if err := remote.Rename(file, renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Stat(file); err == nil {
+		t.Error("renamed file left behind")
+	}
+
+	if got := readRemote(t, remote, renamed); got != "contents" {
+		t.Errorf("got %q, want %q", got, "contents")
+	}
+
+	if err := remote.Remove(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Stat(renamed); err == nil {
+		t.Error("removed directory left behind")
+	}
+}
+
+func TestSftpTransfer(t *testing.T) {
+	filesystems, dir := sftpTestDir(t)
+	remote := filesystems.Within(dir)
+
+	local := t.TempDir()
+	src := filepath.Join(local, "src")
+	if err := os.MkdirAll(filepath.Join(src, "nested"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "nested", "file"), []byte("nested"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("nested/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// From the local disk to the host, and back again
+	if err := copyItems(filesystems, map[string]bool{src: true}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readRemote(t, remote, filepath.Join(dir, "src", "nested", "file")); got != "nested" {
+		t.Errorf("got %q, want %q", got, "nested")
+	}
+
+	if target, err := remote.Readlink(filepath.Join(dir, "src", "link")); err != nil || target != "nested/file" {
+		t.Errorf("got link to %q, %v, want %q", target, err, "nested/file")
+	}
+
+	back := filepath.Join(local, "back")
+	if err := os.Mkdir(back, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyItems(filesystems, map[string]bool{filepath.Join(dir, "src"): true}, back); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(back, "src", "link")); err != nil || string(data) != "nested" {
+		t.Errorf("got %q, %v, want %q", data, err, "nested")
+	}
+
+	// Moving copies the items across, and then removes them
+	if err := os.Mkdir(filepath.Join(local, "moved"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveItems(filesystems, map[string]bool{src: true}, filepath.Join(dir, "src", "nested")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(src); err == nil {
+		t.Error("item moved to the host left behind")
+	}
+
+	moved := filepath.Join(dir, "src", "nested", "src")
+	if err := moveItems(filesystems, map[string]bool{moved: true}, filepath.Join(local, "moved")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Stat(moved); err == nil {
+		t.Error("item moved from the host left behind")
+	}
+
+	if data, err := os.ReadFile(filepath.Join(local, "moved", "src", "nested", "file")); err != nil || string(data) != "nested" {
+		t.Errorf("got %q, %v, want %q", data, err, "nested")
+	}
+}
+
+// Existing items used to be reported as generic failures, so creating files
+// failed and creating archives removed what was already there
+func TestSftpExisting(t *testing.T) {
+	filesystems, dir := sftpTestDir(t)
+	remote := filesystems.Within(dir)
+
+	file := filepath.Join(dir, "file")
+	writeRemote(t, remote, file, "contents", 0644)
+
+	if _, err := remote.Create(file, os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("got %v, want %v", err, fs.ErrExist)
+	}
+
+	if err := createFile(remote, file); err != nil {
+		t.Error(err)
+	}
+
+	if got := readRemote(t, remote, file); got != "contents" {
+		t.Errorf("existing file overwritten with %q", got)
+	}
+
+	archive := filepath.Join(dir, "archive.tar")
+	if err := remote.Mkdir(filepath.Join(archive, "kept"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeArchive(context.Background(), filesystems, archive, ARCHIVE_TAR, []string{file}, &Progress{}); err == nil {
+		t.Error("writing over an existing directory succeeded")
+	}
+
+	if _, err := remote.Stat(filepath.Join(archive, "kept")); err != nil {
+		t.Errorf("existing directory removed: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	gc "github.com/vit1251/go-ncursesw"
+)
+
+// Indexed by the COLOR_* constants, which double as the color pair numbers
+type Theme [COLOR_COUNT]Style
+
+var themeElements = map[string]int16{
+	"title":     COLOR_TITLE,
+	"directory": COLOR_DIR,
+	"file":      COLOR_FILE,
+	"link":      COLOR_LINK,
+	"broken":    COLOR_BROKEN,
+	"mark":      COLOR_MARK,
+	"cursor":    COLOR_CURSOR,
+	"match":     COLOR_MATCH,
+	"error":     COLOR_ERROR,
+	"prompt":    COLOR_PROMPT,
+	"border":    COLOR_BORDER,
+	"status":    COLOR_STATUS,
+}
+
+func defaultTheme() Theme {
+	var theme Theme
+	for i := range theme {
+		theme[i] = Style{fg: -1, bg: -1}
+	}
+
+	theme[COLOR_TITLE] = Style{attr: gc.A_BOLD, fg: gc.C_CYAN, bg: -1}
+	theme[COLOR_DIR] = Style{fg: gc.C_BLUE, bg: -1}
+	theme[COLOR_LINK] = Style{fg: gc.C_CYAN, bg: -1}
+	theme[COLOR_BROKEN] = Style{fg: gc.C_RED, bg: -1}
+	theme[COLOR_MARK] = Style{attr: gc.A_BOLD, fg: gc.C_MAGENTA, bg: -1}
+	theme[COLOR_CURSOR] = Style{attr: gc.A_REVERSE, fg: -1, bg: -1}
+	theme[COLOR_MATCH] = Style{fg: gc.C_BLACK, bg: gc.C_YELLOW}
+	theme[COLOR_ERROR] = Style{attr: gc.A_BOLD, fg: gc.C_RED, bg: -1}
+	theme[COLOR_PROMPT] = Style{attr: gc.A_BOLD, fg: gc.C_BLUE, bg: -1}
+	return theme
+}
+
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// Accepts names ("red", "bright-red", "default"), 256 color indices ("208")
+// and hex colors ("#ff8700"). Hex colors are approximated with the 256 color
+// palette, which is further degraded by fitColor() if the terminal has less.
+func parseColor(word string) (int16, bool) {
+	if word == "default" {
+		return -1, true
+	}
+
+	for i, name := range colorNames {
+		if word == name {
+			return int16(i), true
+		}
+
+		if word == "bright-"+name {
+			return int16(i + 8), true
+		}
+	}
+
+	if strings.HasPrefix(word, "#") && len(word) == 7 {
+		rgb, err := strconv.ParseUint(word[1:], 16, 32)
+		if err != nil {
+			return 0, false
+		}
+
+		return rgbTo256(int(rgb>>16&0xff), int(rgb>>8&0xff), int(rgb&0xff)), true
+	}
+
+	if n, err := strconv.Atoi(word); err == nil && n >= 0 && n < 256 {
+		return int16(n), true
+	}
+
+	return 0, false
+}
+
+// Parses a list of attributes and colors, like "bold red on #303030"
+func parseStyle(value string) (Style, error) {
+	style := Style{fg: -1, bg: -1}
+	background := false
+
+	for _, word := range strings.Fields(strings.ToLower(value)) {
+		switch word {
+		case "none":
+			style.attr = 0
+		case "bold":
+			style.attr |= gc.A_BOLD
+		case "dim":
+			style.attr |= gc.A_DIM
+		case "underline":
+			style.attr |= gc.A_UNDERLINE
+		case "blink":
+			style.attr |= gc.A_BLINK
+		case "reverse":
+			style.attr |= gc.A_REVERSE
+		case "on":
+			background = true
+
+		default:
+			color, ok := parseColor(word)
+			if !ok {
+				return style, fmt.Errorf("invalid color '%s'", word)
+			}
+
+			if background {
+				style.bg = color
+			} else {
+				style.fg = color
+			}
+		}
+	}
+
+	return style, nil
+}
+
+func parseTheme(config Config) (Theme, error) {
+	theme := defaultTheme()
+	for key, value := range config["theme"] {
+		element, ok := themeElements[key]
+		if !ok {
+			return theme, fmt.Errorf("theme: unknown element '%s'", key)
+		}
+
+		style, err := parseStyle(value)
+		if err != nil {
+			return theme, fmt.Errorf("theme: %s: %w", key, err)
+		}
+
+		theme[element] = style
+	}
+
+	return theme, nil
+}
+
+func (s Style) HasColor() bool {
+	return s.fg != -1 || s.bg != -1
+}
+
+func (fm *Fm) StyleOn(element int16) {
+	style := fm.theme[element]
+	fm.window.AttrOn(style.attr)
+	if style.HasColor() {
+		fm.window.ColorOn(element)
+	}
+}
+
+func (fm *Fm) StyleOff(element int16) {
+	style := fm.theme[element]
+	fm.window.AttrOff(style.attr)
+	if style.HasColor() {
+		fm.window.ColorOff(element)
+	}
+}